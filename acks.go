@@ -0,0 +1,75 @@
+package main
+
+import (
+	"time"
+)
+
+// recentActionIDs is how many action IDs are remembered per player. A retry
+// that arrives after that many newer actions is applied again.
+const recentActionIDs = 64
+
+type ReceiveAckEvent struct {
+	ID        string    `json:"id"`
+	Duplicate bool      `json:"duplicate,omitempty"`
+	Sent      time.Time `json:"sent"`
+}
+
+// actionWindow holds the most recent action IDs a player sent, oldest first.
+// It lives on the player rather than the client so a retry sent after a
+// reconnect is still caught.
+type actionWindow struct {
+	ids  []string
+	seen map[string]bool
+}
+
+// Record adds an action ID to the window and reports whether it was already
+// there.
+func (w *actionWindow) Record(id string) bool {
+	if w.seen[id] {
+		return true
+	}
+	if w.seen == nil {
+		w.seen = map[string]bool{}
+	}
+
+	if len(w.ids) == recentActionIDs {
+		delete(w.seen, w.ids[0])
+		w.ids = w.ids[1:]
+	}
+	w.ids = append(w.ids, id)
+	w.seen[id] = true
+	return false
+}
+
+// isDuplicateAction records an action ID against the player the client
+// controls and reports whether that player already sent it. An ID is spent
+// even if the action fails, so clients retry a rejected action under a new
+// one. Clients without a player have no window and are never deduplicated.
+func (m *Manager) isDuplicateAction(c *Client, id string) bool {
+	gameID, playerID := c.Binding()
+	if playerID == "" {
+		return false
+	}
+	game, err := m.GetGame(gameID)
+	if err != nil {
+		return false
+	}
+
+	duplicate := false
+	game.Do(func() error {
+		if player, exists := game.State.Players[playerID]; exists {
+			duplicate = player.actions.Record(id)
+		}
+		return nil
+	})
+	return duplicate
+}
+
+func sendAck(c *Client, id string, duplicate bool) error {
+	response := ReceiveAckEvent{
+		ID:        id,
+		Duplicate: duplicate,
+		Sent:      time.Now(),
+	}
+	return BroadcastEvent(EventReceiveAck, response, []*Client{c})
+}
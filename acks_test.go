@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestActionWindow(t *testing.T) {
+	var window actionWindow
+
+	if window.Record("first") {
+		t.Fatalf("new ID reported as a duplicate")
+	}
+	if !window.Record("first") {
+		t.Fatalf("repeated ID not reported as a duplicate")
+	}
+
+	// fill the window so the first ID is the oldest one left to evict
+	for i := 1; i < recentActionIDs; i++ {
+		window.Record(fmt.Sprintf("action-%d", i))
+	}
+	if !window.Record("first") {
+		t.Fatalf("ID forgotten while the window still had room")
+	}
+
+	window.Record("one-too-many")
+	if window.Record("first") {
+		t.Errorf("oldest ID still remembered after the window filled up")
+	}
+	if !window.Record("one-too-many") {
+		t.Errorf("newest ID forgotten")
+	}
+	if len(window.ids) != recentActionIDs || len(window.seen) != recentActionIDs {
+		t.Errorf("window holds %d IDs (%d seen), want %d", len(window.ids), len(window.seen), recentActionIDs)
+	}
+}
+
+func TestRouteEventSpendsIDsOfFailedActions(t *testing.T) {
+	store, err := NewFileGameStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(context.Background(), store)
+	c := NewClient(nil, m, JSONCodec{})
+	c.protocolVersion = ProtocolVersion
+
+	if err := m.routeEvent(Event{Type: EventSendInitializeGame, Payload: json.RawMessage(`{}`)}, c); err != nil {
+		t.Fatal(err)
+	}
+	drain(c)
+
+	// the game hasn't started, so the move fails but its ID is spent
+	move := Event{Type: EventSendPlayerMove, Payload: json.RawMessage(`{"hex":{"r":0,"q":1}}`), ID: "move-1"}
+	if err := m.routeEvent(move, c); err != nil {
+		t.Fatal(err)
+	}
+	if got := drain(c); len(got) != 2 || got[0] != EventReceiveError || got[1] != EventReceiveAck {
+		t.Fatalf("first attempt got %v, want an error then an ack", got)
+	}
+
+	if err := m.routeEvent(move, c); err != nil {
+		t.Fatal(err)
+	}
+	retry := <-c.egress
+	var ack ReceiveAckEvent
+	if err := json.Unmarshal(retry.Payload, &ack); err != nil {
+		t.Fatal(err)
+	}
+	if retry.Type != EventReceiveAck || ack.ID != "move-1" || !ack.Duplicate {
+		t.Errorf("retry got %s %s, want a duplicate ack for move-1", retry.Type, retry.Payload)
+	}
+	if got := drain(c); len(got) != 0 {
+		t.Errorf("retry also got %v", got)
+	}
+}
+
+// drain empties a client's egress and returns the types of the events in it.
+func drain(c *Client) []string {
+	types := []string{}
+	for {
+		select {
+		case event := <-c.egress:
+			types = append(types, event.Type)
+		default:
+			return types
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"slices"
+	"time"
+)
+
+type Alliance struct {
+	PlayerA string `json:"playerA"`
+	PlayerB string `json:"playerB"`
+}
+
+type AllianceProposal struct {
+	ProposerID string `json:"proposerID"`
+	TargetID   string `json:"targetID"`
+}
+
+func (a Alliance) Includes(playerID string) bool {
+	return a.PlayerA == playerID || a.PlayerB == playerID
+}
+
+func (a Alliance) Ally(playerID string) string {
+	if a.PlayerA == playerID {
+		return a.PlayerB
+	}
+	return a.PlayerA
+}
+
+func (gs *GameState) AreAllied(playerA, playerB string) bool {
+	return slices.ContainsFunc(gs.Alliances, func(alliance Alliance) bool {
+		return alliance.Includes(playerA) && alliance.Includes(playerB)
+	})
+}
+
+func (gs *GameState) Allies(playerID string) []string {
+	allies := []string{}
+	for _, alliance := range gs.Alliances {
+		if alliance.Includes(playerID) {
+			allies = append(allies, alliance.Ally(playerID))
+		}
+	}
+	return allies
+}
+
+func (gs *GameState) AddAlliance(playerA, playerB string) {
+	gs.Alliances = append(gs.Alliances, Alliance{PlayerA: playerA, PlayerB: playerB})
+	gs.RemoveAllianceProposal(playerA, playerB)
+	gs.RemoveAllianceProposal(playerB, playerA)
+}
+
+func (gs *GameState) RemoveAlliance(playerA, playerB string) {
+	gs.Alliances = slices.DeleteFunc(gs.Alliances, func(alliance Alliance) bool {
+		return alliance.Includes(playerA) && alliance.Includes(playerB)
+	})
+}
+
+func (gs *GameState) HasAllianceProposal(proposerID, targetID string) bool {
+	return slices.Contains(gs.AllianceProposals, AllianceProposal{ProposerID: proposerID, TargetID: targetID})
+}
+
+func (gs *GameState) AddAllianceProposal(proposerID, targetID string) {
+	if !gs.HasAllianceProposal(proposerID, targetID) {
+		gs.AllianceProposals = append(gs.AllianceProposals, AllianceProposal{ProposerID: proposerID, TargetID: targetID})
+	}
+}
+
+func (gs *GameState) RemoveAllianceProposal(proposerID, targetID string) {
+	gs.AllianceProposals = slices.DeleteFunc(gs.AllianceProposals, func(proposal AllianceProposal) bool {
+		return proposal.ProposerID == proposerID && proposal.TargetID == targetID
+	})
+}
+
+// EliminatePlayer takes a player out of the game along with any alliances
+// and proposals they were part of.
+func (gs *GameState) EliminatePlayer(player *Player) {
+	player.State = nil
+
+	gs.Alliances = slices.DeleteFunc(gs.Alliances, func(alliance Alliance) bool {
+		return alliance.Includes(player.ID)
+	})
+	gs.AllianceProposals = slices.DeleteFunc(gs.AllianceProposals, func(proposal AllianceProposal) bool {
+		return proposal.ProposerID == player.ID || proposal.TargetID == player.ID
+	})
+}
+
+// BreakAlliance ends an alliance and announces the betrayal to everyone in
+// the game.
+func (g *Game) BreakAlliance(betrayer, betrayed *Player) error {
+	g.State.RemoveAlliance(betrayer.ID, betrayed.ID)
+
+	return BroadcastGameState(g, EventReceiveBetrayal, func(state GameState) any {
+		return ReceiveBetrayalEvent{
+			BetrayerID:    betrayer.ID,
+			BetrayerColor: betrayer.Color,
+			BetrayedID:    betrayed.ID,
+			BetrayedColor: betrayed.Color,
+			GameState:     state,
+			Sent:          time.Now(),
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	maxChatMessageLength = 200
+	maxChatHistory       = 50
+
+	chatRateLimit  = 5
+	chatRateWindow = 10 * time.Second
+)
+
+type ChatMessage struct {
+	SenderID    string    `json:"senderID"`
+	SenderColor string    `json:"senderColor"`
+	RecipientID string    `json:"recipientID,omitempty"`
+	Message     string    `json:"message"`
+	Sent        time.Time `json:"sent"`
+}
+
+func (m ChatMessage) IsPrivate() bool {
+	return m.RecipientID != ""
+}
+
+// CanSee reports whether a player may read a message. Public messages are
+// visible to everyone, whispers only to the sender and recipient.
+func (m ChatMessage) CanSee(playerID string) bool {
+	return !m.IsPrivate() || m.SenderID == playerID || m.RecipientID == playerID
+}
+
+func (g *Game) AddChatMessage(message ChatMessage) {
+	g.ChatHistory = append(g.ChatHistory, message)
+	if len(g.ChatHistory) > maxChatHistory {
+		g.ChatHistory = g.ChatHistory[len(g.ChatHistory)-maxChatHistory:]
+	}
+}
+
+// ChatHistoryFor returns the messages a player may read, oldest first.
+// Spectators pass an empty player ID and only get public messages.
+func (g *Game) ChatHistoryFor(playerID string) []ChatMessage {
+	history := []ChatMessage{}
+	for _, message := range g.ChatHistory {
+		if message.CanSee(playerID) {
+			history = append(history, message)
+		}
+	}
+	return history
+}
+
+func validateChatMessage(message string) (string, error) {
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return "", newActionError(ErrorInvalidMessage, "Message is empty")
+	}
+	if utf8.RuneCountInString(message) > maxChatMessageLength {
+		return "", newActionError(ErrorInvalidMessage, "Message is longer than %d characters", maxChatMessageLength)
+	}
+	return message, nil
+}
+
+// allowChatMessage applies a sliding window rate limit to the client's chat
+// messages.
+func (c *Client) allowChatMessage() bool {
+	now := time.Now()
+
+	recent := []time.Time{}
+	for _, sent := range c.chatTimes {
+		if now.Sub(sent) < chatRateWindow {
+			recent = append(recent, sent)
+		}
+	}
+	c.chatTimes = recent
+
+	if len(c.chatTimes) >= chatRateLimit {
+		return false
+	}
+	c.chatTimes = append(c.chatTimes, now)
+	return true
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
-	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,6 +12,10 @@ var (
 	pongWait = 10 * time.Second
 
 	pingInterval = (pongWait * 9) / 10
+
+	// how many events may queue up for a client before it's considered too
+	// slow and disconnected
+	egressBufferSize = 64
 )
 
 type ClientList map[*Client]bool
@@ -19,17 +23,115 @@ type ClientList map[*Client]bool
 type Client struct {
 	connection *websocket.Conn
 	manager    *Manager
+	codec      Codec
 
-	GameID string
+	// the game and player the client is bound to, guarded by mu since both
+	// the client's reader and its game's loop use them
+	gameID      string
+	playerID    string
+	mu          sync.Mutex
+	ConnectedAt time.Time
 
+	// egress is closed exactly once, under mu, when the client goes away
 	egress chan Event
+	closed bool
+
+	// deltas is set, under mu, when the client asks for state changes instead
+	// of the full game state, either with ?deltas=1 or in its hello
+	deltas bool
+
+	// protocolVersion is what the client announced in its hello. It's only
+	// used by the reader goroutine.
+	protocolVersion int
+
+	chatTimes []time.Time
 }
 
-func NewClient(conn *websocket.Conn, manager *Manager) *Client {
+func NewClient(conn *websocket.Conn, manager *Manager, codec Codec) *Client {
 	return &Client{
-		connection: conn,
-		manager:    manager,
-		egress:     make(chan Event),
+		connection:  conn,
+		manager:     manager,
+		codec:       codec,
+		egress:      make(chan Event, egressBufferSize),
+		ConnectedAt: time.Now(),
+
+		protocolVersion: legacyVersion,
+	}
+}
+
+func (c *Client) GameID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gameID
+}
+
+func (c *Client) PlayerID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.playerID
+}
+
+// Binding returns the client's game and player together.
+func (c *Client) Binding() (gameID, playerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.gameID, c.playerID
+}
+
+// Bind points the client at a game and the player it controls there.
+// Spectators have no player; binding to an empty game detaches the client.
+func (c *Client) Bind(gameID, playerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gameID = gameID
+	c.playerID = playerID
+}
+
+func (c *Client) EnableDeltas() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deltas = true
+}
+
+func (c *Client) WantsDeltas() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.deltas
+}
+
+// send queues an event for the client without blocking. A client whose queue
+// is full has fallen too far behind and is disconnected.
+func (c *Client) send(event Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	select {
+	case c.egress <- event:
+	default:
+		log.Printf("evicting slow client %s", c.playerID)
+		c.closed = true
+		close(c.egress)
+		go c.manager.removeClient(c)
+	}
+}
+
+func (c *Client) closeEgress() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.egress)
 	}
 }
 
@@ -42,7 +144,7 @@ func (c *Client) readMessages() {
 		log.Println("pong read err", err)
 	}
 
-	c.connection.SetReadLimit(512)
+	c.connection.SetReadLimit(1024)
 
 	c.connection.SetPongHandler(c.pongHandler)
 
@@ -56,9 +158,8 @@ func (c *Client) readMessages() {
 			break
 		}
 
-		var request Event
-
-		if err := json.Unmarshal(payload, &request); err != nil {
+		request, err := c.codec.Decode(payload)
+		if err != nil {
 			log.Printf("error marshalling event :%v", err)
 			break
 		}
@@ -75,6 +176,7 @@ func (c *Client) writeMessages() {
 	}()
 
 	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
@@ -87,16 +189,18 @@ func (c *Client) writeMessages() {
 				return
 			}
 
-			data, err := json.Marshal(message)
+			data, err := c.codec.Encode(message)
 			if err != nil {
 				log.Println(err)
 				return
 			}
 
-			if err := c.connection.WriteMessage(websocket.TextMessage, data); err != nil {
+			if err := c.connection.WriteMessage(c.codec.MessageType(), data); err != nil {
 				log.Printf("failed to send message: %v", err)
+				return
 			}
-			log.Printf("message sent: %v", string(data))
+			// payloads carry rejoin tokens and private messages
+			log.Printf("message sent: %s", message.Type)
 
 		case <-ticker.C:
 			// log.Println("ping")
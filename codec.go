@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+)
+
+// Codec turns events into websocket messages and back. Handlers always work
+// with JSON payloads, so binary codecs transcode them at the edge.
+type Codec interface {
+	Name() string
+	MessageType() int
+	Encode(event Event) ([]byte, error)
+	Decode(data []byte) (Event, error)
+}
+
+var codecs = map[string]Codec{
+	"json": JSONCodec{},
+	"cbor": newCBORCodec(),
+}
+
+// codecSubprotocols are offered to clients in order of preference, so a client
+// offering both gets the default.
+var codecSubprotocols = []string{"json", "cbor"}
+
+// NegotiateCodec picks the codec for a new connection. A websocket subprotocol
+// wins over the encoding query param, and JSON is the default.
+func NegotiateCodec(conn *websocket.Conn, r *http.Request) Codec {
+	if codec, ok := codecs[conn.Subprotocol()]; ok {
+		return codec
+	}
+	if codec, ok := codecs[r.URL.Query().Get("encoding")]; ok {
+		return codec
+	}
+	return codecs["json"]
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (JSONCodec) Encode(event Event) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func (JSONCodec) Decode(data []byte) (Event, error) {
+	var event Event
+	err := json.Unmarshal(data, &event)
+	return event, err
+}
+
+// CBORCodec sends events as CBOR. Payloads become native CBOR maps rather
+// than embedded JSON. Integers stay CBOR integers and other numbers are sent
+// as the shortest float that holds them.
+type CBORCodec struct {
+	encMode cbor.EncMode
+	decMode cbor.DecMode
+}
+
+type cborEvent struct {
+	Type      string `cbor:"type"`
+	Payload   any    `cbor:"payload"`
+	RequestID string `cbor:"requestId,omitempty"`
+	ID        string `cbor:"id,omitempty"`
+}
+
+func newCBORCodec() CBORCodec {
+	encMode, err := cbor.EncOptions{ShortestFloat: cbor.ShortestFloat16}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	decMode, err := cbor.DecOptions{DefaultMapType: reflect.TypeOf(map[string]any(nil))}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return CBORCodec{encMode: encMode, decMode: decMode}
+}
+
+func (CBORCodec) Name() string {
+	return "cbor"
+}
+
+func (CBORCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+func (c CBORCodec) Encode(event Event) ([]byte, error) {
+	var payload any
+	if len(event.Payload) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(event.Payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&payload); err != nil {
+			return nil, fmt.Errorf("failed to transcode %s payload: %v", event.Type, err)
+		}
+		payload = cborNumbers(payload)
+	}
+	return c.encMode.Marshal(cborEvent{Type: event.Type, Payload: payload, RequestID: event.RequestID, ID: event.ID})
+}
+
+func (c CBORCodec) Decode(data []byte) (Event, error) {
+	var wire cborEvent
+	if err := c.decMode.Unmarshal(data, &wire); err != nil {
+		return Event{}, err
+	}
+
+	payload, err := json.Marshal(wire.Payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("failed to transcode %s payload: %v", wire.Type, err)
+	}
+	return Event{Type: wire.Type, Payload: payload, RequestID: wire.RequestID, ID: wire.ID}, nil
+}
+
+// cborNumbers swaps the JSON numbers in a decoded payload for integers where
+// they are whole, so they aren't sent as floats.
+func cborNumbers(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]any:
+		for key, field := range value {
+			value[key] = cborNumbers(field)
+		}
+	case []any:
+		for i, element := range value {
+			value[i] = cborNumbers(element)
+		}
+	}
+	return value
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestCBORCodecRoundTrip(t *testing.T) {
+	codec := newCBORCodec()
+	tests := []struct {
+		name  string
+		event Event
+	}{
+		{
+			name: "state",
+			event: Event{
+				Type:    EventReceivePlayerMove,
+				Payload: json.RawMessage(`{"gameState":{"players":{"alice":{"id":"alice","state":{"hearts":3,"actionPoints":0,"position":{"r":-2,"q":4}}}}},"seq":12}`),
+			},
+		},
+		{
+			name: "floats",
+			event: Event{
+				Type:    EventReceiveClockUpdate,
+				Payload: json.RawMessage(`{"seconds":1.5,"ratio":0.1}`),
+			},
+		},
+		{
+			name: "ids",
+			event: Event{
+				Type:      EventSendPlayerShoot,
+				Payload:   json.RawMessage(`{"playerID":"alice","hex":{"r":1,"q":2}}`),
+				RequestID: "req-1",
+				ID:        "action-1",
+			},
+		},
+		{
+			name:  "no payload",
+			event: Event{Type: EventSendHello},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := codec.Encode(test.event)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			decoded, err := codec.Decode(data)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+
+			if decoded.Type != test.event.Type || decoded.RequestID != test.event.RequestID || decoded.ID != test.event.ID {
+				t.Errorf("envelope = %+v, want %+v", decoded, test.event)
+			}
+			if len(test.event.Payload) > 0 && !sameJSON(t, decoded.Payload, test.event.Payload) {
+				t.Errorf("payload = %s, want %s", decoded.Payload, test.event.Payload)
+			}
+		})
+	}
+}
+
+func TestCBORCodecEncodesIntegersAsIntegers(t *testing.T) {
+	codec := newCBORCodec()
+	data, err := codec.Encode(Event{
+		Type:    EventReceivePlayerMove,
+		Payload: json.RawMessage(`{"seq":12,"hearts":-1,"range":1.5}`),
+	})
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	var wire struct {
+		Payload map[string]any `cbor:"payload"`
+	}
+	if err := cbor.Unmarshal(data, &wire); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if seq, ok := wire.Payload["seq"].(uint64); !ok || seq != 12 {
+		t.Errorf("seq = %#v, want uint64 12", wire.Payload["seq"])
+	}
+	if hearts, ok := wire.Payload["hearts"].(int64); !ok || hearts != -1 {
+		t.Errorf("hearts = %#v, want int64 -1", wire.Payload["hearts"])
+	}
+	if r, ok := wire.Payload["range"].(float64); !ok || r != 1.5 {
+		t.Errorf("range = %#v, want float64 1.5", wire.Payload["range"])
+	}
+}
+
+func sameJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var x, y any
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatalf("Unmarshal %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatalf("Unmarshal %s: %v", b, err)
+	}
+	xs, _ := json.Marshal(x)
+	ys, _ := json.Marshal(y)
+	return string(xs) == string(ys)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// Change types in a state delta. Players drop out of and come back into a
+// view under fog of war, so added and removed are relative to what the
+// recipient could see before.
+const (
+	ChangePlayerAdded      = "player_added"
+	ChangePlayerRemoved    = "player_removed"
+	ChangePlayerEliminated = "player_eliminated"
+	ChangeHearts           = "hearts"
+	ChangeRange            = "range"
+	ChangeActionPoints     = "action_points"
+	ChangePosition         = "position"
+	ChangeCellsInRange     = "cells_in_range"
+	ChangeCellsAtMaxRange  = "cells_at_max_range"
+	ChangeStatus           = "status"
+	ChangeJuryVotes        = "jury_votes"
+	ChangeHeartPickups     = "heart_pickups"
+	ChangeStormCenter      = "storm_center"
+	ChangeSafeRadius       = "safe_radius"
+	ChangeTerrain          = "terrain"
+	ChangeAlliances        = "alliances"
+	ChangeSeriesScore      = "series_score"
+	ChangeRematchRequests  = "rematch_requests"
+)
+
+type StateChange struct {
+	Type     string `json:"type"`
+	PlayerID string `json:"playerID,omitempty"`
+	Value    any    `json:"value,omitempty"`
+}
+
+// DiffGameState lists the changes that turn one view of a game into the
+// next.
+func DiffGameState(from, to GameState) []StateChange {
+	changes := []StateChange{}
+
+	for playerID, player := range to.Players {
+		previous, exists := from.Players[playerID]
+		if !exists || (previous.State == nil && player.State != nil) {
+			changes = append(changes, StateChange{Type: ChangePlayerAdded, PlayerID: playerID, Value: player})
+			continue
+		}
+		changes = append(changes, diffPlayer(previous, player)...)
+	}
+	for playerID := range from.Players {
+		if _, exists := to.Players[playerID]; !exists {
+			changes = append(changes, StateChange{Type: ChangePlayerRemoved, PlayerID: playerID})
+		}
+	}
+
+	if from.Status != to.Status {
+		changes = append(changes, StateChange{Type: ChangeStatus, Value: to.Status})
+	}
+	if !maps.Equal(from.JuryVotes, to.JuryVotes) {
+		changes = append(changes, StateChange{Type: ChangeJuryVotes, Value: to.JuryVotes})
+	}
+	if !slices.Equal(from.HeartPickups, to.HeartPickups) {
+		changes = append(changes, StateChange{Type: ChangeHeartPickups, Value: to.HeartPickups})
+	}
+	if from.StormCenter != to.StormCenter {
+		changes = append(changes, StateChange{Type: ChangeStormCenter, Value: to.StormCenter})
+	}
+	if from.SafeRadius != to.SafeRadius {
+		changes = append(changes, StateChange{Type: ChangeSafeRadius, Value: to.SafeRadius})
+	}
+	if !slices.Equal(from.Terrain, to.Terrain) {
+		changes = append(changes, StateChange{Type: ChangeTerrain, Value: to.Terrain})
+	}
+	if !slices.Equal(from.Alliances, to.Alliances) {
+		changes = append(changes, StateChange{Type: ChangeAlliances, Value: to.Alliances})
+	}
+	if !maps.Equal(from.SeriesScore, to.SeriesScore) {
+		changes = append(changes, StateChange{Type: ChangeSeriesScore, Value: to.SeriesScore})
+	}
+	if !slices.Equal(from.RematchRequests, to.RematchRequests) {
+		changes = append(changes, StateChange{Type: ChangeRematchRequests, Value: to.RematchRequests})
+	}
+
+	return changes
+}
+
+func diffPlayer(from, to *Player) []StateChange {
+	changes := []StateChange{}
+	if from.State == nil {
+		return changes
+	}
+	if to.State == nil {
+		return append(changes, StateChange{Type: ChangePlayerEliminated, PlayerID: to.ID})
+	}
+
+	if from.State.Hearts != to.State.Hearts {
+		changes = append(changes, StateChange{Type: ChangeHearts, PlayerID: to.ID, Value: to.State.Hearts})
+	}
+	if from.State.Range != to.State.Range {
+		changes = append(changes, StateChange{Type: ChangeRange, PlayerID: to.ID, Value: to.State.Range})
+	}
+	if from.State.ActionPoints != to.State.ActionPoints {
+		changes = append(changes, StateChange{Type: ChangeActionPoints, PlayerID: to.ID, Value: to.State.ActionPoints})
+	}
+	if from.State.Position != to.State.Position {
+		changes = append(changes, StateChange{Type: ChangePosition, PlayerID: to.ID, Value: to.State.Position})
+	}
+	if !slices.Equal(from.State.CellsInRange, to.State.CellsInRange) {
+		changes = append(changes, StateChange{Type: ChangeCellsInRange, PlayerID: to.ID, Value: to.State.CellsInRange})
+	}
+	if !slices.Equal(from.State.CellsAtMaxRange, to.State.CellsAtMaxRange) {
+		changes = append(changes, StateChange{Type: ChangeCellsAtMaxRange, PlayerID: to.ID, Value: to.State.CellsAtMaxRange})
+	}
+	return changes
+}
+
+// withStateDelta rewrites a state event for a client that opted into deltas.
+// Every such event carries the game's sequence number; when the client has a
+// baseline to diff against, its gameState is swapped for the changes.
+func withStateDelta(payload any, seq int, changes []StateChange) (any, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal state event: %v", err)
+	}
+
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("state event is not an object: %v", err)
+	}
+
+	if fields["seq"], err = json.Marshal(seq); err != nil {
+		return nil, err
+	}
+	if changes != nil {
+		delete(fields, "gameState")
+		if fields["changes"], err = json.Marshal(changes); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
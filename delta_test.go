@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffGameStateFogAndElimination(t *testing.T) {
+	settings := DefaultGameSettings()
+	settings.FogOfWar = true
+	game, clients := newViewTestGame(settings)
+	alice := clients["alice"]
+	bob := game.State.Players["bob"]
+
+	before := game.ViewFor(alice)
+
+	// bob walks out of alice's sight
+	bob.State.Position = Hex{R: 8, Q: 8}
+	hidden := game.ViewFor(alice)
+	assertChanges(t, "leaving the view", DiffGameState(before, hidden), StateChange{Type: ChangePlayerRemoved, PlayerID: "bob"})
+
+	// and comes back
+	bob.State.Position = Hex{R: 4, Q: 5}
+	visible := game.ViewFor(alice)
+	changes := DiffGameState(hidden, visible)
+	if len(changes) != 1 || changes[0].Type != ChangePlayerAdded || changes[0].PlayerID != "bob" {
+		t.Errorf("coming back into view: changes = %+v, want bob added", changes)
+	}
+
+	bob.State = nil
+	eliminated := game.ViewFor(alice)
+	assertChanges(t, "elimination", DiffGameState(visible, eliminated), StateChange{Type: ChangePlayerEliminated, PlayerID: "bob"})
+}
+
+func TestDiffGameStateUnchanged(t *testing.T) {
+	game, clients := newViewTestGame(DefaultGameSettings())
+	view := game.ViewFor(clients["alice"])
+
+	if changes := DiffGameState(view, game.ViewFor(clients["alice"])); len(changes) != 0 {
+		t.Errorf("changes = %+v, want none", changes)
+	}
+}
+
+func assertChanges(t *testing.T, name string, got []StateChange, want ...StateChange) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s: changes = %+v, want %+v", name, got, want)
+		return
+	}
+	for i := range want {
+		if got[i].Type != want[i].Type || got[i].PlayerID != want[i].PlayerID {
+			t.Errorf("%s: changes = %+v, want %+v", name, got, want)
+			return
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Error codes sent with receive_error, so clients can react to a failure
+// without parsing its message.
+const (
+	ErrorBadPayload       = "BAD_PAYLOAD"
+	ErrorGameNotFound     = "GAME_NOT_FOUND"
+	ErrorReplayNotFound   = "REPLAY_NOT_FOUND"
+	ErrorPlayerNotFound   = "PLAYER_NOT_FOUND"
+	ErrorNotAPlayer       = "NOT_A_PLAYER"
+	ErrorSpoofedPlayer    = "SPOOFED_PLAYER"
+	ErrorNotHost          = "NOT_HOST"
+	ErrorWrongStatus      = "WRONG_GAME_STATUS"
+	ErrorLobbyFull        = "LOBBY_FULL"
+	ErrorPlayerExists     = "PLAYER_EXISTS"
+	ErrorRejoinFailed     = "REJOIN_FAILED"
+	ErrorInvalidSettings  = "INVALID_SETTINGS"
+	ErrorBoardFull        = "BOARD_FULL"
+	ErrorEliminated       = "PLAYER_ELIMINATED"
+	ErrorNotEnoughAP      = "NOT_ENOUGH_AP"
+	ErrorOutOfRange       = "OUT_OF_RANGE"
+	ErrorCellOccupied     = "CELL_OCCUPIED"
+	ErrorCellEmpty        = "CELL_EMPTY"
+	ErrorCellNotPlayable  = "CELL_NOT_PLAYABLE"
+	ErrorLineOfSight      = "LINE_OF_SIGHT_BLOCKED"
+	ErrorInvalidTarget    = "INVALID_TARGET"
+	ErrorConfirmAlly      = "ALLY_CONFIRMATION_REQUIRED"
+	ErrorAlliance         = "INVALID_ALLIANCE"
+	ErrorNotAllowed       = "NOT_ALLOWED"
+	ErrorAlreadyRequested = "ALREADY_REQUESTED"
+	ErrorInvalidMessage   = "INVALID_MESSAGE"
+	ErrorRateLimited      = "RATE_LIMITED"
+	ErrorInternal         = "INTERNAL_ERROR"
+	ErrorSpectatorsFull   = "SPECTATORS_FULL"
+)
+
+var errGameNotFound = newActionError(ErrorGameNotFound, "Game not found")
+
+// ActionError is a failed request the client should hear about. Handlers
+// return it and routeEvent turns it into an error event.
+type ActionError struct {
+	Code    string
+	Message string
+
+	// PlayerID is the player an action was attempted for, set on spoofed
+	// actions.
+	PlayerID string
+}
+
+func (e *ActionError) Error() string {
+	return e.Message
+}
+
+func newActionError(code string, format string, args ...any) *ActionError {
+	return &ActionError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type ReceiveErrorEvent struct {
+	Code      string    `json:"code"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"requestId,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	Sent      time.Time `json:"sent"`
+}
+
+// sendError tells the client why its request failed, echoing whichever of
+// the request ID and action ID it sent. Anything that isn't an ActionError
+// is reported as an internal error. Clients from before the hello handshake
+// only understand the free-text invalid and spoofed action events.
+func sendError(c *Client, request Event, err error) error {
+	var actionErr *ActionError
+	if !errors.As(err, &actionErr) {
+		actionErr = newActionError(ErrorInternal, "Something went wrong")
+	}
+
+	if c.protocolVersion < structuredErrorsVersion {
+		if actionErr.Code == ErrorSpoofedPlayer {
+			response := ReceiveSpoofedActionEvent{
+				Message:  actionErr.Message,
+				PlayerID: actionErr.PlayerID,
+				Sent:     time.Now(),
+			}
+			return BroadcastEvent(EventReceiveSpoofedAction, response, []*Client{c})
+		}
+		return sendInvalidAction(c, actionErr.Message)
+	}
+
+	response := ReceiveErrorEvent{
+		Code:      actionErr.Code,
+		Message:   actionErr.Message,
+		RequestID: request.RequestID,
+		ID:        request.ID,
+		Sent:      time.Now(),
+	}
+	return BroadcastEvent(EventReceiveError, response, []*Client{c})
+}
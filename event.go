@@ -2,13 +2,23 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"slices"
 	"time"
 )
 
+var replayInterval = 500 * time.Millisecond
+
 type Event struct {
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
+	// RequestID is chosen by the client and echoed back on errors
+	RequestID string `json:"requestId,omitempty"`
+	// ID makes an action idempotent: it is acked, echoed on errors, and a
+	// repeat is dropped
+	ID string `json:"id,omitempty"`
 }
 
 type EventHandler func(event Event, c *Client) error
@@ -32,6 +42,43 @@ const (
 	EventReceivePlayerWin             = "receive_player_win"
 	EventReceiveActionPoint           = "receive_action_point"
 	EventReceiveClockUpdate           = "receive_clock_update"
+	EventSendJuryVote                 = "send_jury_vote"
+	EventReceiveJuryVote              = "receive_jury_vote"
+	EventReceiveJuryResults           = "receive_jury_results"
+	EventSendRejoinGame               = "send_rejoin_game"
+	EventReceiveRejoinGame            = "receive_rejoin_game"
+	EventReceiveSpoofedAction         = "receive_spoofed_action"
+	EventSendRequestReplay            = "send_request_replay"
+	EventReceiveReplay                = "receive_replay"
+	EventSendUpdateSettings           = "send_update_settings"
+	EventReceiveUpdateSettings        = "receive_update_settings"
+	EventSendSpectateGame             = "send_spectate_game"
+	EventReceiveSpectateGame          = "receive_spectate_game"
+	EventSendChatMessage              = "send_chat_message"
+	EventReceiveChatMessage           = "receive_chat_message"
+	EventSendPrivateMessage           = "send_private_message"
+	EventReceivePrivateMessage        = "receive_private_message"
+	EventSendProposeAlliance          = "send_propose_alliance"
+	EventReceiveAllianceProposal      = "receive_alliance_proposal"
+	EventSendAcceptAlliance           = "send_accept_alliance"
+	EventSendBreakAlliance            = "send_break_alliance"
+	EventReceiveAllianceUpdate        = "receive_alliance_update"
+	EventReceiveBetrayal              = "receive_betrayal"
+	EventReceiveHostChanged           = "receive_host_changed"
+	EventSendLeaveGame                = "send_leave_game"
+	EventSendKickPlayer               = "send_kick_player"
+	EventReceivePlayerLeft            = "receive_player_left"
+	EventReceiveKicked                = "receive_kicked"
+	EventSendRequestRematch           = "send_request_rematch"
+	EventReceiveRematchRequest        = "receive_rematch_request"
+	EventReceiveRematch               = "receive_rematch"
+	EventSendRequestSnapshot          = "send_request_snapshot"
+	EventReceiveStateSnapshot         = "receive_state_snapshot"
+	EventSendHello                    = "send_hello"
+	EventReceiveHello                 = "receive_hello"
+	EventReceiveUpgradeRequired       = "receive_upgrade_required"
+	EventReceiveError                 = "receive_error"
+	EventReceiveAck                   = "receive_ack"
 )
 
 type ReceiveInvalidActionEvent struct {
@@ -39,10 +86,81 @@ type ReceiveInvalidActionEvent struct {
 	Sent    time.Time
 }
 
+type SendHelloEvent struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type ReceiveHelloEvent struct {
+	Version      int       `json:"version"`
+	MinVersion   int       `json:"minVersion"`
+	Capabilities []string  `json:"capabilities"`
+	Events       []string  `json:"events"`
+	Encoding     string    `json:"encoding"`
+	Sent         time.Time `json:"sent"`
+}
+
+type ReceiveUpgradeRequiredEvent struct {
+	Message    string    `json:"message"`
+	Version    int       `json:"version"`
+	MinVersion int       `json:"minVersion"`
+	Sent       time.Time `json:"sent"`
+}
+
+type ReceiveSpoofedActionEvent struct {
+	Message  string    `json:"message"`
+	PlayerID string    `json:"playerID"`
+	Sent     time.Time `json:"sent"`
+}
+
 type ReceivePlayerWinEvent struct {
-	GameState   GameState `json:"gameState"`
-	PlayerColor string    `json:"playerColor"`
-	Sent        time.Time `json:"sent"`
+	GameID          string    `json:"gameID"`
+	GameState       GameState `json:"gameState"`
+	PlayerColor     string    `json:"playerColor"`
+	RematchDeadline time.Time `json:"rematchDeadline"`
+	Seq             int       `json:"seq"`
+	Sent            time.Time `json:"sent"`
+}
+
+type ReceiveStateSnapshotEvent struct {
+	Seq       int       `json:"seq"`
+	GameState GameState `json:"gameState"`
+	Seconds   int       `json:"seconds"`
+	Sent      time.Time `json:"sent"`
+}
+
+type SendRequestRematchEvent struct {
+	PlayerID string `json:"playerID"`
+}
+
+type ReceiveRematchRequestEvent struct {
+	PlayerID        string    `json:"playerID"`
+	PlayerColor     string    `json:"playerColor"`
+	RematchDeadline time.Time `json:"rematchDeadline"`
+	GameState       GameState `json:"gameState"`
+	Sent            time.Time `json:"sent"`
+}
+
+type ReceiveRematchEvent struct {
+	JoinCode     string       `json:"joinCode"`
+	PlayerCount  int          `json:"playerCount"`
+	IsMainClient bool         `json:"isMainClient"`
+	Settings     GameSettings `json:"settings"`
+	GameState    GameState    `json:"gameState"`
+	PlayerID     string       `json:"playerID,omitempty"`
+	Token        string       `json:"token,omitempty"`
+	Sent         time.Time    `json:"sent"`
+}
+
+type SendRequestReplayEvent struct {
+	GameID string `json:"gameID"`
+}
+
+type ReceiveReplayEvent struct {
+	GameID string       `json:"gameID"`
+	Entry  JournalEntry `json:"entry"`
+	Total  int          `json:"total"`
+	Sent   time.Time    `json:"sent"`
 }
 
 type ReceiveActionPointEvent struct {
@@ -55,12 +173,31 @@ type ReceiveClockUpdateEvent struct {
 	Sent    time.Time `json:"sent"`
 }
 
+type SendJuryVoteEvent struct {
+	PlayerID    string `json:"playerID"`
+	CandidateID string `json:"candidateID"`
+}
+
+type ReceiveJuryVoteEvent struct {
+	GameState GameState `json:"gameState"`
+	Sent      time.Time `json:"sent"`
+}
+
+type ReceiveJuryResultsEvent struct {
+	GameState   GameState      `json:"gameState"`
+	Votes       map[string]int `json:"votes"`
+	PlayerColor string         `json:"playerColor"`
+	Sent        time.Time      `json:"sent"`
+}
+
 type SendInitializeGameEvent struct {
 	PlayerID string `json:"playerID"`
 }
 
 type ReceiveInitializeGameEvent struct {
 	JoinCode string    `json:"joinCode"`
+	PlayerID string    `json:"playerID"`
+	Token    string    `json:"token"`
 	Sent     time.Time `json:"sent"`
 }
 
@@ -71,11 +208,139 @@ type SendJoinGameEvent struct {
 }
 
 type ReceiveJoinGameEvent struct {
-	PlayerCount  int       `json:"playerCount"`
+	PlayerCount  int          `json:"playerCount"`
+	IsMainClient bool         `json:"isMainClient"`
+	Settings     GameSettings `json:"settings"`
+	PlayerID     string       `json:"playerID,omitempty"`
+	Token        string       `json:"token,omitempty"`
+	Sent         time.Time    `json:"sent"`
+}
+
+type SendSpectateGameEvent struct {
+	JoinCode string `json:"joinCode"`
+}
+
+type ReceiveSpectateGameEvent struct {
+	JoinCode    string        `json:"joinCode"`
+	PlayerCount int           `json:"playerCount"`
+	GameState   GameState     `json:"gameState"`
+	Seconds     int           `json:"seconds"`
+	ChatHistory []ChatMessage `json:"chatHistory"`
+	Sent        time.Time     `json:"sent"`
+}
+
+type SendChatMessageEvent struct {
+	PlayerID string `json:"playerID"`
+	Message  string `json:"message"`
+}
+
+type SendPrivateMessageEvent struct {
+	PlayerID    string `json:"playerID"`
+	RecipientID string `json:"recipientID"`
+	Message     string `json:"message"`
+}
+
+type ReceiveChatMessageEvent struct {
+	ChatMessage ChatMessage `json:"chatMessage"`
+	Sent        time.Time   `json:"sent"`
+}
+
+type SendProposeAllianceEvent struct {
+	PlayerID string `json:"playerID"`
+	TargetID string `json:"targetID"`
+}
+
+type ReceiveAllianceProposalEvent struct {
+	ProposerID    string    `json:"proposerID"`
+	ProposerColor string    `json:"proposerColor"`
+	Sent          time.Time `json:"sent"`
+}
+
+type SendAcceptAllianceEvent struct {
+	PlayerID   string `json:"playerID"`
+	ProposerID string `json:"proposerID"`
+}
+
+type SendBreakAllianceEvent struct {
+	PlayerID string `json:"playerID"`
+	AllyID   string `json:"allyID"`
+}
+
+type ReceiveAllianceUpdateEvent struct {
+	GameState GameState `json:"gameState"`
+	Sent      time.Time `json:"sent"`
+}
+
+type ReceiveBetrayalEvent struct {
+	BetrayerID    string    `json:"betrayerID"`
+	BetrayerColor string    `json:"betrayerColor"`
+	BetrayedID    string    `json:"betrayedID"`
+	BetrayedColor string    `json:"betrayedColor"`
+	GameState     GameState `json:"gameState"`
+	Sent          time.Time `json:"sent"`
+}
+
+type SendRejoinGameEvent struct {
+	PlayerID string `json:"playerID"`
+	Token    string `json:"token"`
+}
+
+type ReceiveRejoinGameEvent struct {
+	JoinCode     string        `json:"joinCode"`
+	PlayerCount  int           `json:"playerCount"`
+	IsMainClient bool          `json:"isMainClient"`
+	GameState    GameState     `json:"gameState"`
+	Seconds      int           `json:"seconds"`
+	ChatHistory  []ChatMessage `json:"chatHistory"`
+	Sent         time.Time     `json:"sent"`
+}
+
+type SendUpdateSettingsEvent struct {
+	PlayerID string       `json:"playerID"`
+	Settings GameSettings `json:"settings"`
+}
+
+type ReceiveUpdateSettingsEvent struct {
+	Settings GameSettings `json:"settings"`
+	Sent     time.Time    `json:"sent"`
+}
+
+type ReceiveHostChangedEvent struct {
+	PlayerID     string    `json:"playerID"`
+	PlayerColor  string    `json:"playerColor"`
 	IsMainClient bool      `json:"isMainClient"`
 	Sent         time.Time `json:"sent"`
 }
 
+type SendLeaveGameEvent struct {
+	PlayerID string `json:"playerID"`
+}
+
+type SendKickPlayerEvent struct {
+	PlayerID string `json:"playerID"`
+	TargetID string `json:"targetID"`
+}
+
+type ReceivePlayerLeftEvent struct {
+	PlayerID    string    `json:"playerID"`
+	PlayerColor string    `json:"playerColor"`
+	PlayerCount int       `json:"playerCount"`
+	GameState   GameState `json:"gameState"`
+	Sent        time.Time `json:"sent"`
+}
+
+// Reasons a client is dropped from a game with receive_kicked.
+const (
+	KickedByHost    = "host"
+	KickedNoRematch = "no_rematch"
+)
+
+type ReceiveKickedEvent struct {
+	JoinCode string    `json:"joinCode"`
+	Reason   string    `json:"reason"`
+	Sent     time.Time `json:"sent"`
+}
+
 type SendStartGameEvent struct {
 	PlayerID string `json:"playerID"`
 }
@@ -96,8 +361,9 @@ type ReceivePlayerMoveEvent struct {
 }
 
 type SendPlayerShootEvent struct {
-	PlayerID string `json:"playerID"`
-	Hex      Hex    `json:"hex"`
+	PlayerID    string `json:"playerID"`
+	Hex         Hex    `json:"hex"`
+	ConfirmAlly bool   `json:"confirmAlly"`
 }
 
 type ReceivePlayerShootEvent struct {
@@ -124,77 +390,130 @@ type ReceivePlayerGiveActionPointEvent struct {
 	Sent      time.Time `json:"sent"`
 }
 
-func InitializeGameHandler(event Event, c *Client) error {
-	c.manager.Lock()
+func HelloHandler(event Event, c *Client) error {
+	var payload SendHelloEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	c.protocolVersion = min(payload.Version, ProtocolVersion)
+	if c.protocolVersion < MinProtocolVersion {
+		return sendUpgradeRequired(c, fmt.Sprintf("Protocol version %d is no longer supported", payload.Version))
+	}
+
+	capabilities := negotiateCapabilities(payload.Capabilities)
+	if slices.Contains(capabilities, CapabilityDeltas) {
+		c.EnableDeltas()
+	}
+
+	response := ReceiveHelloEvent{
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Capabilities: capabilities,
+		Events:       c.manager.supportedEvents(),
+		Encoding:     c.codec.Name(),
+		Sent:         time.Now(),
+	}
+	return BroadcastEvent(EventReceiveHello, response, []*Client{c})
+}
 
+// newPlayerIDFor issues the ID for a client's new player. The bundled web
+// client still makes up its own ID and never reads ours back, so legacy
+// clients keep the ID they ask for. That fallback goes away once
+// MinProtocolVersion reaches serverIssuedIDsVersion.
+func newPlayerIDFor(c *Client, requested string) string {
+	if requested != "" && c.protocolVersion < serverIssuedIDsVersion {
+		return requested
+	}
+	return NewPlayerID()
+}
+
+func InitializeGameHandler(event Event, c *Client) error {
 	var payload SendInitializeGameEvent
 	if err := ParsePayload(event.Payload, &payload); err != nil {
 		return err
 	}
 
+	if c.GameID() != "" {
+		c.manager.detachClient(c)
+	}
+
+	playerID := newPlayerIDFor(c, payload.PlayerID)
+
 	gameID := NewGameID()
 	joinCode := NewJoinCode(3)
 	game := NewGame()
 
 	game.ID = gameID
 	game.JoinCode = joinCode
+	game.Journal = NewJournal(gameID)
 	game.MainClient = c
 	game.LastUpdate = time.Now()
 
-	c.GameID = gameID
-	c.manager.games[gameID] = game
-	c.manager.Unlock()
-
-	player, err := CreateNewPlayer(payload.PlayerID, c, game)
+	player, err := CreateNewPlayer(playerID, c, game)
 	if err != nil {
 		return fmt.Errorf("failed to create player: %v", err)
 	}
 
 	player.Color = "#264BCC"
-	game.Lock()
-	defer game.Unlock()
 	game.State.AddPlayer(player)
 
+	c.Bind(gameID, playerID)
+	c.manager.AddGame(game)
+
 	response := ReceiveInitializeGameEvent{
 		JoinCode: joinCode,
+		PlayerID: player.ID,
+		Token:    c.manager.SignPlayerToken(gameID, player.ID),
 		Sent:     time.Now(),
 	}
 	return BroadcastEvent(EventReceiveInitializeGame, response, []*Client{c})
 }
 
 func JoinGameHandler(event Event, c *Client) error {
-	c.manager.Lock()
-	defer c.manager.Unlock()
-
 	var payload SendJoinGameEvent
 	if err := ParsePayload(event.Payload, &payload); err != nil {
 		return err
 	}
 
-	for _, game := range c.manager.games {
-		if payload.JoinCode != game.JoinCode {
-			continue
+	game, err := c.manager.FindGame(payload.JoinCode)
+	if err != nil {
+		return err
+	}
+
+	if gameID := c.GameID(); gameID != "" && gameID != game.ID {
+		c.manager.detachClient(c)
+	}
+
+	return game.Do(func() error {
+		if game.State.Status != "initialized" {
+			return newActionError(ErrorWrongStatus, "Game already started")
 		}
 
-		game.Lock()
-		defer game.Unlock()
+		// a retried join would otherwise add a second player for this client
+		if gameID, playerID := c.Binding(); gameID == game.ID && playerID != "" {
+			return newActionError(ErrorPlayerExists, "Already in this game")
+		}
 
-		if game.State.Status == "in_progress" {
-			return sendInvalidAction(c, "Game already started")
+		if len(game.State.Players) >= game.Settings.MaxPlayers {
+			return newActionError(ErrorLobbyFull, "Lobby full")
 		}
 
-		if len(game.State.Players) >= 8 {
-			return sendInvalidAction(c, "Lobby full")
+		playerID := newPlayerIDFor(c, payload.PlayerID)
+
+		if _, exists := game.State.Players[playerID]; exists {
+			return newActionError(ErrorPlayerExists, "Player already in game")
 		}
 
-		player, err := CreateNewPlayer(payload.PlayerID, c, game)
+		player, err := CreateNewPlayer(playerID, c, game)
 		if err != nil {
 			return fmt.Errorf("failed to create player: %v", err)
 		}
-		player.Color = GetPlayerColor(len(game.State.Players) - 1)
+		player.Color = GetPlayerColor(game.State.Players)
 		game.State.AddPlayer(player)
+		delete(game.Spectators, c)
 
-		c.GameID = game.ID
+		c.Bind(game.ID, player.ID)
 
 		game.LastUpdate = time.Now()
 
@@ -202,8 +521,13 @@ func JoinGameHandler(event Event, c *Client) error {
 			response := ReceiveJoinGameEvent{
 				PlayerCount:  len(game.State.Players),
 				IsMainClient: recipient == game.MainClient,
+				Settings:     game.Settings,
 				Sent:         time.Now(),
 			}
+			if recipient == c {
+				response.PlayerID = player.ID
+				response.Token = c.manager.SignPlayerToken(game.ID, player.ID)
+			}
 			err := BroadcastEvent(EventReceiveJoinGame, response, []*Client{recipient})
 			if err != nil {
 				return fmt.Errorf("failed to broadcast event to client %v: %v", recipient, err)
@@ -211,283 +535,968 @@ func JoinGameHandler(event Event, c *Client) error {
 		}
 
 		return nil
-	}
-
-	response := ReceiveInvalidActionEvent{
-		Message: "Join code not found",
-		Sent:    time.Now(),
-	}
-	return BroadcastEvent(EventReceiveInvalidAction, response, []*Client{c})
-}
-
-func GetPlayerColor(playerIndex int) string {
-	colors := []string{"#E40027", "#FF9526", "#F8D034", "#2AA146", "#00CBCB", "#7E60A9", "#EA9AB2"}
-	return colors[playerIndex%len(colors)]
+	})
 }
 
-func StartGameHandler(event Event, c *Client) error {
-	c.manager.Lock()
-	defer c.manager.Unlock()
-
-	var payload SendStartGameEvent
+func SpectateGameHandler(event Event, c *Client) error {
+	var payload SendSpectateGameEvent
 	if err := ParsePayload(event.Payload, &payload); err != nil {
 		return err
 	}
 
-	game := c.manager.games[c.GameID]
+	game, err := c.manager.FindGame(payload.JoinCode)
+	if err != nil {
+		return err
+	}
+
+	if gameID := c.GameID(); gameID != "" && gameID != game.ID {
+		c.manager.detachClient(c)
+	}
 
-	game.Lock()
-	defer game.Unlock()
+	return game.Do(func() error {
+		if len(game.Spectators) >= maxSpectators {
+			return newActionError(ErrorSpectatorsFull, "Too many spectators")
+		}
 
-	game.BoardSize = (2 * len(game.State.Players)) + 1
+		// a player spectating their own game stops controlling their player
+		if c.GameID() == game.ID {
+			if err := game.DetachClient(c); err != nil {
+				return err
+			}
+		}
 
-	for _, player := range game.State.Players {
-		position := GetRandomPosition(game.BoardSize, game.State.Players)
-		player.State.Position = position
-		player.State.CellsInRange = AxialSpiral(game.BoardSize, position, player.State.Range)
-		player.State.CellsAtMaxRange = AxialRing(game.BoardSize, position, player.State.Range)
-	}
+		game.Spectators[c] = true
+		delete(game.baselines, c)
 
-	game.State.Status = "in_progress"
-	game.StartClock()
-	game.LastUpdate = time.Now()
+		c.Bind(game.ID, "")
 
-	response := ReceiveStartGameEvent{
-		GameState: *game.State,
-		Sent:      time.Now(),
-	}
-	return BroadcastEvent(EventReceiveStartGame, response, game.AllClients())
+		response := ReceiveSpectateGameEvent{
+			JoinCode:    game.JoinCode,
+			PlayerCount: len(game.State.Players),
+			GameState:   game.ViewFor(c),
+			Seconds:     int(game.ClockTime.Seconds()),
+			ChatHistory: game.ChatHistoryFor(""),
+			Sent:        time.Now(),
+		}
+		return BroadcastEvent(EventReceiveSpectateGame, response, []*Client{c})
+	})
 }
 
-func PlayerMoveHandler(event Event, c *Client) error {
-	c.manager.Lock()
-	defer c.manager.Unlock()
-
-	var payload SendPlayerMoveEvent
+func RejoinGameHandler(event Event, c *Client) error {
+	var payload SendRejoinGameEvent
 	if err := ParsePayload(event.Payload, &payload); err != nil {
 		return err
 	}
 
-	game := c.manager.games[c.GameID]
-
-	game.Lock()
-	defer game.Unlock()
-
-	player, err := validatePlayerExists(game, payload.PlayerID)
+	game, err := c.manager.FindGameForToken(payload.PlayerID, payload.Token)
 	if err != nil {
-		return sendInvalidAction(c, err.Error())
+		return newActionError(ErrorRejoinFailed, "Unable to rejoin game")
 	}
 
-	if err := validateActionPoints(player); err != nil {
-		return sendInvalidAction(c, err.Error())
+	if gameID := c.GameID(); gameID != "" && gameID != game.ID {
+		c.manager.detachClient(c)
 	}
 
-	if err := validateCellInRange(player, payload.Hex); err != nil {
-		return sendInvalidAction(c, err.Error())
-	}
+	return game.Do(func() error {
+		player, exists := game.State.Players[payload.PlayerID]
+		if !exists {
+			return newActionError(ErrorRejoinFailed, "Unable to rejoin game")
+		}
 
-	if err := validateCellOccupied(game, payload.Hex, false); err != nil {
-		return sendInvalidAction(c, err.Error())
-	}
+		if game.MainClient == nil || game.MainClient.PlayerID() == player.ID {
+			game.MainClient = c
+		}
 
-	player.State.ActionPoints -= 1
-	player.State.Position = payload.Hex
-	player.State.CellsInRange = AxialSpiral(game.BoardSize, payload.Hex, player.State.Range)
-	player.State.CellsAtMaxRange = AxialRing(game.BoardSize, payload.Hex, player.State.Range)
-	game.LastUpdate = time.Now()
+		// the previous connection no longer speaks for the player
+		if previous := player.Client; previous != nil && previous != c {
+			delete(game.baselines, previous)
+			previous.Bind("", "")
+		}
+		game.UnbindClient(c)
+		player.Client = c
 
-	response := ReceivePlayerMoveEvent{
-		GameState: *game.State,
-		Sent:      time.Now(),
-	}
-	return BroadcastEvent(EventReceivePlayerMove, response, game.AllClients())
+		c.Bind(game.ID, player.ID)
+
+		game.LastUpdate = time.Now()
+
+		response := ReceiveRejoinGameEvent{
+			JoinCode:     game.JoinCode,
+			PlayerCount:  len(game.State.Players),
+			IsMainClient: c == game.MainClient,
+			GameState:    game.ViewFor(c),
+			Seconds:      int(game.ClockTime.Seconds()),
+			ChatHistory:  game.ChatHistoryFor(player.ID),
+			Sent:         time.Now(),
+		}
+		return BroadcastEvent(EventReceiveRejoinGame, response, []*Client{c})
+	})
 }
 
-func PlayerShootHandler(event Event, c *Client) error {
-	c.manager.Lock()
-	defer c.manager.Unlock()
+// GetPlayerColor picks the first color no player in the lobby is using, so
+// colors freed by players leaving are handed out again.
+func GetPlayerColor(players map[string]*Player) string {
+	colors := []string{"#E40027", "#FF9526", "#F8D034", "#2AA146", "#00CBCB", "#7E60A9", "#EA9AB2"}
 
-	var payload SendPlayerShootEvent
+	used := make(map[string]bool, len(players))
+	for _, player := range players {
+		used[player.Color] = true
+	}
+	for _, color := range colors {
+		if !used[color] {
+			return color
+		}
+	}
+	return colors[len(players)%len(colors)]
+}
+
+func LeaveGameHandler(event Event, c *Client) error {
+	var payload SendLeaveGameEvent
 	if err := ParsePayload(event.Payload, &payload); err != nil {
 		return err
 	}
 
-	game := c.manager.games[c.GameID]
-
-	game.Lock()
-	unlockNeeded := true
-	defer func() {
-		if unlockNeeded {
-			game.Unlock()
-		}
-	}()
-
-	player, err := validatePlayerExists(game, payload.PlayerID)
+	game, err := c.manager.GetGame(c.GameID())
 	if err != nil {
-		return sendInvalidAction(c, err.Error())
+		return err
 	}
 
-	if err := validateActionPoints(player); err != nil {
-		return sendInvalidAction(c, err.Error())
-	}
+	return game.Do(func() error {
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
+			return err
+		}
 
-	if err := validateCellInRange(player, payload.Hex); err != nil {
-		return sendInvalidAction(c, err.Error())
-	}
+		return c.manager.removePlayer(game, player)
+	})
+}
 
-	target := game.State.GetPlayerAtCell(payload.Hex)
-	if target == nil {
-		return sendInvalidAction(c, "Position not occupied")
-	}
-	if target == player {
-		return sendInvalidAction(c, "Can't shoot yourself")
+func KickPlayerHandler(event Event, c *Client) error {
+	var payload SendKickPlayerEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
 	}
 
-	player.State.ActionPoints -= 1
-	target.State.Hearts -= 1
-	if target.State.Hearts <= 0 {
-		player.State.ActionPoints += target.State.ActionPoints
-		target.State = nil
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
 	}
-	game.LastUpdate = time.Now()
 
-	isWinner := game.State.CheckForWinner()
-	if isWinner {
-		response := ReceivePlayerWinEvent{
-			GameState:   *game.State,
-			PlayerColor: player.Color,
-			Sent:        time.Now(),
-		}
-		if err := BroadcastEvent(EventReceivePlayerWin, response, game.AllClients()); err != nil {
+	return game.Do(func() error {
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
 			return err
 		}
 
-		game.StopClock()
-
-		unlockNeeded = false
-		game.Unlock()
+		if c != game.MainClient {
+			return newActionError(ErrorNotHost, "Only the host can kick players")
+		}
 
-		c.manager.RemoveGame(c.GameID)
+		target, err := validatePlayerExists(game, payload.TargetID)
+		if err != nil {
+			return err
+		}
+		if target == player {
+			return newActionError(ErrorInvalidTarget, "Can't kick yourself")
+		}
 
-		return nil
-	}
+		if target.Client != nil {
+			response := ReceiveKickedEvent{
+				JoinCode: game.JoinCode,
+				Reason:   KickedByHost,
+				Sent:     time.Now(),
+			}
+			if err := BroadcastEvent(EventReceiveKicked, response, []*Client{target.Client}); err != nil {
+				return err
+			}
+		}
 
-	response := ReceivePlayerShootEvent{
-		GameState: *game.State,
-		Sent:      time.Now(),
-	}
-	return BroadcastEvent(EventReceivePlayerShoot, response, game.AllClients())
+		return c.manager.removePlayer(game, target)
+	})
 }
 
-func PlayerIncreaseRangeHandler(event Event, c *Client) error {
-	c.manager.Lock()
-	defer c.manager.Unlock()
-
-	var payload SendPlayerIncreaseRangeEvent
-	if err := ParsePayload(event.Payload, &payload); err != nil {
+// RequestSnapshotHandler resends the full state to a client that noticed a gap
+// in the sequence numbers of its deltas.
+func RequestSnapshotHandler(event Event, c *Client) error {
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
 		return err
 	}
 
-	game := c.manager.games[c.GameID]
+	return game.Do(func() error {
+		view := game.ViewFor(c)
+		if c.WantsDeltas() {
+			game.baselines[c] = view
+		}
 
-	game.Lock()
-	defer game.Unlock()
+		response := ReceiveStateSnapshotEvent{
+			Seq:       game.Seq,
+			GameState: view,
+			Seconds:   int(game.ClockTime.Seconds()),
+			Sent:      time.Now(),
+		}
+		return BroadcastEvent(EventReceiveStateSnapshot, response, []*Client{c})
+	})
+}
 
-	player, err := validatePlayerExists(game, payload.PlayerID)
-	if err != nil {
-		return sendInvalidAction(c, err.Error())
+func RequestRematchHandler(event Event, c *Client) error {
+	var payload SendRequestRematchEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
 	}
 
-	if player.State.ActionPoints < player.State.Range+1 {
-		return sendInvalidAction(c, "Not enough action points")
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
 	}
 
-	player.State.Range += 1
-	player.State.ActionPoints -= player.State.Range
-	player.State.CellsInRange = AxialSpiral(game.BoardSize, player.State.Position, player.State.Range)
-	player.State.CellsAtMaxRange = AxialRing(game.BoardSize, player.State.Position, player.State.Range)
-	game.LastUpdate = time.Now()
+	return game.Do(func() error {
+		if game.State.Status != "finished" {
+			return newActionError(ErrorWrongStatus, "Game isn't over yet")
+		}
 
-	response := ReceivePlayerIncreaseRangeEvent{
-		GameState: *game.State,
-		Sent:      time.Now(),
-	}
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
+			return err
+		}
 
-	return BroadcastEvent(EventReceivePlayerIncreaseRange, response, game.AllClients())
+		if slices.Contains(game.State.RematchRequests, player.ID) {
+			return newActionError(ErrorAlreadyRequested, "Rematch already requested")
+		}
+		game.State.RematchRequests = append(game.State.RematchRequests, player.ID)
+
+		return BroadcastGameState(game, EventReceiveRematchRequest, func(state GameState) any {
+			return ReceiveRematchRequestEvent{
+				PlayerID:        player.ID,
+				PlayerColor:     player.Color,
+				RematchDeadline: game.RematchDeadline,
+				GameState:       state,
+				Sent:            time.Now(),
+			}
+		})
+	})
 }
 
-func PlayerGiveActionPointHandler(event Event, c *Client) error {
-	c.manager.Lock()
-	defer c.manager.Unlock()
-
-	var payload SendPlayerGiveActionPointEvent
+func UpdateSettingsHandler(event Event, c *Client) error {
+	var payload SendUpdateSettingsEvent
 	if err := ParsePayload(event.Payload, &payload); err != nil {
 		return err
 	}
 
-	game := c.manager.games[c.GameID]
-
-	game.Lock()
-	defer game.Unlock()
-
-	player, err := validatePlayerExists(game, payload.PlayerID)
+	game, err := c.manager.GetGame(c.GameID())
 	if err != nil {
-		return sendInvalidAction(c, err.Error())
-	}
-
-	if err := validateActionPoints(player); err != nil {
-		return sendInvalidAction(c, err.Error())
+		return err
 	}
 
-	if err := validateCellInRange(player, payload.Hex); err != nil {
-		return sendInvalidAction(c, err.Error())
-	}
+	return game.Do(func() error {
+		if c != game.MainClient {
+			return newActionError(ErrorNotHost, "Only the host can change settings")
+		}
 
-	target := game.State.GetPlayerAtCell(payload.Hex)
-	if target == nil {
-		return sendInvalidAction(c, "Position not occupied")
-	}
-	if target == player {
-		return sendInvalidAction(c, "Can't give to yourself")
-	}
+		if game.State.Status != "initialized" {
+			return newActionError(ErrorWrongStatus, "Game already started")
+		}
 
-	player.State.ActionPoints -= 1
-	target.State.ActionPoints += 1
-	game.LastUpdate = time.Now()
+		if err := payload.Settings.Validate(len(game.State.Players)); err != nil {
+			return newActionError(ErrorInvalidSettings, "%s", err.Error())
+		}
 
-	response := ReceivePlayerGiveActionPointEvent{
-		GameState: *game.State,
-		Sent:      time.Now(),
-	}
-	return BroadcastEvent(EventReceivePlayerGiveActionPoint, response, game.AllClients())
+		game.Settings = payload.Settings
+		game.LastUpdate = time.Now()
 
+		response := ReceiveUpdateSettingsEvent{
+			Settings: game.Settings,
+			Sent:     time.Now(),
+		}
+		return BroadcastEvent(EventReceiveUpdateSettings, response, game.AllClients())
+	})
 }
 
-func ParsePayload[T any](payload []byte, target *T) error {
-	if err := json.Unmarshal(payload, target); err != nil {
-		return fmt.Errorf("bad payload in request: %v", err)
+func StartGameHandler(event Event, c *Client) error {
+	var payload SendStartGameEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
 	}
-	return nil
-}
 
-func validatePlayerExists(game *Game, playerID string) (*Player, error) {
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		if c != game.MainClient {
+			return newActionError(ErrorNotHost, "Only the host can start the game")
+		}
+
+		if game.State.Status != "initialized" {
+			return newActionError(ErrorWrongStatus, "Game already started")
+		}
+
+		// lay out the board before touching the game, so a board too small
+		// for everyone leaves the lobby as it was
+		boardSize := game.Settings.BoardSize(len(game.State.Players))
+		center := Hex{R: boardSize / 2, Q: boardSize / 2}
+		var terrain map[Hex]string
+		if game.Settings.TerrainEnabled {
+			terrain = GenerateTerrain(boardSize, center)
+		}
+		positions, ok := SpawnPositions(boardSize, center, terrain, len(game.State.Players))
+		if !ok {
+			return newActionError(ErrorBoardFull, "Board is full")
+		}
+
+		game.BoardSize = boardSize
+		game.State.StormCenter = center
+		game.State.SafeRadius = boardSize / 2
+		game.Terrain = terrain
+		game.State.Terrain = TerrainCells(terrain)
+
+		for _, player := range game.State.Players {
+			player.State.Hearts = game.Settings.StartingHearts
+			player.State.Range = game.Settings.StartingRange
+			player.State.Position = positions[0]
+			positions = positions[1:]
+			game.UpdatePlayerRange(player)
+		}
+
+		game.State.Status = "in_progress"
+		game.ClockInterval = game.Settings.ClockInterval()
+		game.ClockTime = game.ClockInterval
+		game.StartClock()
+		game.LastUpdate = time.Now()
+		game.Record(JournalStart, "", nil)
+
+		return BroadcastGameState(game, EventReceiveStartGame, func(state GameState) any {
+			return ReceiveStartGameEvent{
+				GameState: state,
+				Sent:      time.Now(),
+			}
+		})
+	})
+}
+
+func PlayerMoveHandler(event Event, c *Client) error {
+	var payload SendPlayerMoveEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		if game.State.Status != "in_progress" {
+			return newActionError(ErrorWrongStatus, "Game not in progress")
+		}
+
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
+			return err
+		}
+
+		if err := validatePlayerAlive(player); err != nil {
+			return err
+		}
+
+		cost := game.MoveCost(payload.Hex)
+		if err := validateActionPointCost(player, cost); err != nil {
+			return err
+		}
+
+		if err := validateCellInRange(player, payload.Hex); err != nil {
+			return err
+		}
+
+		if err := validateCellOccupied(game, payload.Hex, false); err != nil {
+			return err
+		}
+
+		if err := validateCellPlayable(game, payload.Hex); err != nil {
+			return err
+		}
+
+		player.State.ActionPoints -= cost
+		player.State.Position = payload.Hex
+		if game.State.TakeHeartPickup(payload.Hex) {
+			player.State.Hearts += 1
+		}
+		game.UpdatePlayerRange(player)
+		game.LastUpdate = time.Now()
+		game.Record(JournalMove, player.ID, &payload.Hex)
+
+		return BroadcastGameState(game, EventReceivePlayerMove, func(state GameState) any {
+			return ReceivePlayerMoveEvent{
+				GameState: state,
+				Sent:      time.Now(),
+			}
+		})
+	})
+}
+
+func PlayerShootHandler(event Event, c *Client) error {
+	var payload SendPlayerShootEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		if game.State.Status != "in_progress" {
+			return newActionError(ErrorWrongStatus, "Game not in progress")
+		}
+
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
+			return err
+		}
+
+		if err := validatePlayerAlive(player); err != nil {
+			return err
+		}
+
+		if err := validateActionPoints(player); err != nil {
+			return err
+		}
+
+		if err := validateCellInRange(player, payload.Hex); err != nil {
+			return err
+		}
+
+		target := game.State.GetPlayerAtCell(payload.Hex)
+		if target == nil {
+			return newActionError(ErrorCellEmpty, "Position not occupied")
+		}
+		if target == player {
+			return newActionError(ErrorInvalidTarget, "Can't shoot yourself")
+		}
+
+		if err := validateLineOfSight(game, player.State.Position, payload.Hex); err != nil {
+			return err
+		}
+
+		if game.State.AreAllied(player.ID, target.ID) {
+			if !payload.ConfirmAlly {
+				return newActionError(ErrorConfirmAlly, "That player is your ally, confirm to shoot them")
+			}
+			if err := game.BreakAlliance(player, target); err != nil {
+				return err
+			}
+		}
+
+		player.State.ActionPoints -= 1
+		target.State.Hearts -= 1
+		if target.State.Hearts <= 0 {
+			player.State.ActionPoints += target.State.ActionPoints
+			game.State.EliminatePlayer(target)
+		}
+		game.LastUpdate = time.Now()
+		game.Record(JournalShoot, player.ID, &payload.Hex)
+
+		isWinner := game.State.CheckForWinner()
+		if isWinner {
+			if err := game.AnnounceWinner(); err != nil {
+				return err
+			}
+			c.manager.archiveGame(game)
+
+			return nil
+		}
+
+		return BroadcastGameState(game, EventReceivePlayerShoot, func(state GameState) any {
+			return ReceivePlayerShootEvent{
+				GameState: state,
+				Sent:      time.Now(),
+			}
+		})
+	})
+}
+
+func PlayerIncreaseRangeHandler(event Event, c *Client) error {
+	var payload SendPlayerIncreaseRangeEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		if game.State.Status != "in_progress" {
+			return newActionError(ErrorWrongStatus, "Game not in progress")
+		}
+
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
+			return err
+		}
+
+		if err := validatePlayerAlive(player); err != nil {
+			return err
+		}
+
+		cost := game.Settings.RangeUpgradeAPCost(player.State.Range)
+		if player.State.ActionPoints < cost {
+			return newActionError(ErrorNotEnoughAP, "Not enough action points")
+		}
+
+		player.State.Range += 1
+		player.State.ActionPoints -= cost
+		game.UpdatePlayerRange(player)
+		game.LastUpdate = time.Now()
+		game.Record(JournalIncreaseRange, player.ID, nil)
+
+		return BroadcastGameState(game, EventReceivePlayerIncreaseRange, func(state GameState) any {
+			return ReceivePlayerIncreaseRangeEvent{
+				GameState: state,
+				Sent:      time.Now(),
+			}
+		})
+	})
+}
+
+func PlayerGiveActionPointHandler(event Event, c *Client) error {
+	var payload SendPlayerGiveActionPointEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		if game.State.Status != "in_progress" {
+			return newActionError(ErrorWrongStatus, "Game not in progress")
+		}
+
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
+			return err
+		}
+
+		if err := validatePlayerAlive(player); err != nil {
+			return err
+		}
+
+		if err := validateActionPoints(player); err != nil {
+			return err
+		}
+
+		if err := validateCellInRange(player, payload.Hex); err != nil {
+			return err
+		}
+
+		target := game.State.GetPlayerAtCell(payload.Hex)
+		if target == nil {
+			return newActionError(ErrorCellEmpty, "Position not occupied")
+		}
+		if target == player {
+			return newActionError(ErrorInvalidTarget, "Can't give to yourself")
+		}
+
+		player.State.ActionPoints -= 1
+		target.State.ActionPoints += 1
+		game.LastUpdate = time.Now()
+		game.Record(JournalGiveActionPoint, player.ID, &payload.Hex)
+
+		return BroadcastGameState(game, EventReceivePlayerGiveActionPoint, func(state GameState) any {
+			return ReceivePlayerGiveActionPointEvent{
+				GameState: state,
+				Sent:      time.Now(),
+			}
+		})
+	})
+}
+
+func JuryVoteHandler(event Event, c *Client) error {
+	var payload SendJuryVoteEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		if game.State.Status != "in_progress" {
+			return newActionError(ErrorWrongStatus, "Game not in progress")
+		}
+
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
+			return err
+		}
+
+		if player.State != nil {
+			return newActionError(ErrorNotAllowed, "Only eliminated players can vote")
+		}
+
+		candidate, exists := game.State.Players[payload.CandidateID]
+		if !exists || candidate.State == nil {
+			return newActionError(ErrorInvalidTarget, "Jurors can only vote for a living player")
+		}
+
+		game.State.JuryVotes[player.ID] = candidate.ID
+		game.LastUpdate = time.Now()
+
+		return BroadcastGameState(game, EventReceiveJuryVote, func(state GameState) any {
+			return ReceiveJuryVoteEvent{
+				GameState: state,
+				Sent:      time.Now(),
+			}
+		})
+	})
+}
+
+func ProposeAllianceHandler(event Event, c *Client) error {
+	var payload SendProposeAllianceEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		player, target, err := validateAllianceMembers(game, c, payload.PlayerID, payload.TargetID)
+		if err != nil {
+			return err
+		}
+
+		if game.State.AreAllied(player.ID, target.ID) {
+			return newActionError(ErrorAlliance, "Already allied")
+		}
+
+		// proposing to someone who already proposed to you seals the alliance
+		if game.State.HasAllianceProposal(target.ID, player.ID) {
+			game.State.AddAlliance(target.ID, player.ID)
+			game.LastUpdate = time.Now()
+
+			return BroadcastGameState(game, EventReceiveAllianceUpdate, func(state GameState) any {
+				return ReceiveAllianceUpdateEvent{
+					GameState: state,
+					Sent:      time.Now(),
+				}
+			})
+		}
+
+		game.State.AddAllianceProposal(player.ID, target.ID)
+		game.LastUpdate = time.Now()
+
+		if target.Client == nil {
+			return nil
+		}
+
+		response := ReceiveAllianceProposalEvent{
+			ProposerID:    player.ID,
+			ProposerColor: player.Color,
+			Sent:          time.Now(),
+		}
+		return BroadcastEvent(EventReceiveAllianceProposal, response, []*Client{target.Client})
+	})
+}
+
+func AcceptAllianceHandler(event Event, c *Client) error {
+	var payload SendAcceptAllianceEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		player, proposer, err := validateAllianceMembers(game, c, payload.PlayerID, payload.ProposerID)
+		if err != nil {
+			return err
+		}
+
+		if !game.State.HasAllianceProposal(proposer.ID, player.ID) {
+			return newActionError(ErrorAlliance, "No alliance proposal from that player")
+		}
+
+		game.State.AddAlliance(proposer.ID, player.ID)
+		game.LastUpdate = time.Now()
+
+		return BroadcastGameState(game, EventReceiveAllianceUpdate, func(state GameState) any {
+			return ReceiveAllianceUpdateEvent{
+				GameState: state,
+				Sent:      time.Now(),
+			}
+		})
+	})
+}
+
+func BreakAllianceHandler(event Event, c *Client) error {
+	var payload SendBreakAllianceEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		player, ally, err := validateAllianceMembers(game, c, payload.PlayerID, payload.AllyID)
+		if err != nil {
+			return err
+		}
+
+		if !game.State.AreAllied(player.ID, ally.ID) {
+			return newActionError(ErrorAlliance, "Not allied with that player")
+		}
+
+		game.LastUpdate = time.Now()
+
+		return game.BreakAlliance(player, ally)
+	})
+}
+
+func ChatMessageHandler(event Event, c *Client) error {
+	var payload SendChatMessageEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
+			return err
+		}
+
+		message, err := validateChatMessage(payload.Message)
+		if err != nil {
+			return err
+		}
+
+		if !c.allowChatMessage() {
+			return newActionError(ErrorRateLimited, "Slow down")
+		}
+
+		chatMessage := ChatMessage{
+			SenderID:    player.ID,
+			SenderColor: player.Color,
+			Message:     message,
+			Sent:        time.Now(),
+		}
+		game.AddChatMessage(chatMessage)
+		game.LastUpdate = time.Now()
+
+		response := ReceiveChatMessageEvent{
+			ChatMessage: chatMessage,
+			Sent:        time.Now(),
+		}
+		return BroadcastEvent(EventReceiveChatMessage, response, game.AllClients())
+	})
+}
+
+func PrivateMessageHandler(event Event, c *Client) error {
+	var payload SendPrivateMessageEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	game, err := c.manager.GetGame(c.GameID())
+	if err != nil {
+		return err
+	}
+
+	return game.Do(func() error {
+		player, err := validatePlayerIdentity(game, c, payload.PlayerID)
+		if err != nil {
+			return err
+		}
+
+		recipient, err := validatePlayerExists(game, payload.RecipientID)
+		if err != nil {
+			return err
+		}
+		if recipient == player {
+			return newActionError(ErrorInvalidTarget, "Can't message yourself")
+		}
+
+		message, err := validateChatMessage(payload.Message)
+		if err != nil {
+			return err
+		}
+
+		if !c.allowChatMessage() {
+			return newActionError(ErrorRateLimited, "Slow down")
+		}
+
+		chatMessage := ChatMessage{
+			SenderID:    player.ID,
+			SenderColor: player.Color,
+			RecipientID: recipient.ID,
+			Message:     message,
+			Sent:        time.Now(),
+		}
+		game.AddChatMessage(chatMessage)
+		game.LastUpdate = time.Now()
+
+		// the recipient may be offline; they'll get the whisper from the chat
+		// history when they rejoin
+		clients := []*Client{c}
+		if recipient.Client != nil {
+			clients = append(clients, recipient.Client)
+		}
+
+		response := ReceiveChatMessageEvent{
+			ChatMessage: chatMessage,
+			Sent:        time.Now(),
+		}
+		return BroadcastEvent(EventReceivePrivateMessage, response, clients)
+	})
+}
+
+func RequestReplayHandler(event Event, c *Client) error {
+	var payload SendRequestReplayEvent
+	if err := ParsePayload(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	journal, err := c.manager.store.LoadReplay(payload.GameID)
+	if errors.Is(err, ErrReplayNotFound) {
+		return newActionError(ErrorReplayNotFound, "Replay not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for _, entry := range journal.Entries {
+			if !c.manager.hasClient(c) {
+				return
+			}
+
+			response := ReceiveReplayEvent{
+				GameID: journal.GameID,
+				Entry:  entry,
+				Total:  len(journal.Entries),
+				Sent:   time.Now(),
+			}
+			if err := BroadcastEvent(EventReceiveReplay, response, []*Client{c}); err != nil {
+				log.Printf("failed to send replay: %v", err)
+				return
+			}
+
+			time.Sleep(replayInterval)
+		}
+	}()
+
+	return nil
+}
+
+func ParsePayload[T any](payload []byte, target *T) error {
+	if err := json.Unmarshal(payload, target); err != nil {
+		return newActionError(ErrorBadPayload, "Bad payload in request: %v", err)
+	}
+	return nil
+}
+
+// validatePlayerIdentity resolves the player bound to the client when it
+// joined. A payload PlayerID is optional, but if present it must match.
+func validatePlayerIdentity(game *Game, c *Client, playerID string) (*Player, error) {
+	if game.Spectators[c] {
+		return nil, newActionError(ErrorNotAPlayer, "Spectators can't take actions")
+	}
+	gameID, boundPlayerID := c.Binding()
+	if playerID != "" && playerID != boundPlayerID {
+		return nil, &ActionError{Code: ErrorSpoofedPlayer, Message: "Action sent for another player", PlayerID: playerID}
+	}
+	if gameID != game.ID {
+		return nil, newActionError(ErrorNotAPlayer, "Not a player in this game")
+	}
+
+	player, err := validatePlayerExists(game, boundPlayerID)
+	if err != nil {
+		return nil, err
+	}
+	if player.Client != c {
+		return nil, newActionError(ErrorNotAPlayer, "Player resumed from another connection")
+	}
+	return player, nil
+}
+
+// validateAllianceMembers resolves the calling player and the other side of an
+// alliance action. Both must still be alive.
+func validateAllianceMembers(game *Game, c *Client, playerID, otherID string) (*Player, *Player, error) {
+	if game.State.Status != "in_progress" {
+		return nil, nil, newActionError(ErrorWrongStatus, "Game not in progress")
+	}
+
+	player, err := validatePlayerIdentity(game, c, playerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := validatePlayerAlive(player); err != nil {
+		return nil, nil, err
+	}
+
+	other, err := validatePlayerExists(game, otherID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if other.State == nil {
+		return nil, nil, newActionError(ErrorEliminated, "That player has been eliminated")
+	}
+	if other == player {
+		return nil, nil, newActionError(ErrorInvalidTarget, "Can't ally with yourself")
+	}
+
+	return player, other, nil
+}
+
+func validatePlayerExists(game *Game, playerID string) (*Player, error) {
 	player, exists := game.State.Players[playerID]
 	if !exists {
-		return nil, fmt.Errorf("player %s not found in game", playerID)
+		return nil, newActionError(ErrorPlayerNotFound, "player %s not found in game", playerID)
 	}
 	return player, nil
 }
 
+func validatePlayerAlive(player *Player) error {
+	if player.State == nil {
+		return newActionError(ErrorEliminated, "You have been eliminated")
+	}
+	return nil
+}
+
 func validateActionPoints(player *Player) error {
-	if player.State.ActionPoints == 0 {
-		return fmt.Errorf("Not enough action points")
+	return validateActionPointCost(player, 1)
+}
+
+func validateActionPointCost(player *Player, cost int) error {
+	if player.State.ActionPoints < cost {
+		return newActionError(ErrorNotEnoughAP, "Not enough action points")
 	}
 	return nil
 }
 
 func validateCellInRange(player *Player, hex Hex) error {
 	if !player.State.IsCellInRange(hex) {
-		return fmt.Errorf("Position out of range")
+		return newActionError(ErrorOutOfRange, "Position out of range")
 	}
 	return nil
 }
@@ -495,10 +1504,36 @@ func validateCellInRange(player *Player, hex Hex) error {
 func validateCellOccupied(game *Game, hex Hex, expectOccupied bool) error {
 	playerAtCell := game.State.GetPlayerAtCell(hex)
 	if expectOccupied && playerAtCell == nil {
-		return fmt.Errorf("Position not occupied")
+		return newActionError(ErrorCellEmpty, "Position not occupied")
 	}
 	if !expectOccupied && playerAtCell != nil {
-		return fmt.Errorf("Position occupied")
+		return newActionError(ErrorCellOccupied, "Position occupied")
+	}
+	return nil
+}
+
+// validateLineOfSight checks the cells between shooter and target. Walls
+// always block a shot; other players only do when the line of sight rule is on.
+func validateLineOfSight(game *Game, from, to Hex) error {
+	line := AxialLine(from, to)
+	// nothing can stand between a cell and itself or its neighbors
+	if len(line) < 3 {
+		return nil
+	}
+	for _, hex := range line[1 : len(line)-1] {
+		if game.Terrain[hex] == TerrainWall {
+			return newActionError(ErrorLineOfSight, "Shot blocked by a wall")
+		}
+		if game.Settings.LineOfSight && game.State.GetPlayerAtCell(hex) != nil {
+			return newActionError(ErrorLineOfSight, "Shot blocked by another player")
+		}
+	}
+	return nil
+}
+
+func validateCellPlayable(game *Game, hex Hex) error {
+	if !game.IsHexPlayable(hex) {
+		return newActionError(ErrorCellNotPlayable, "Position in the storm")
 	}
 	return nil
 }
@@ -511,6 +1546,45 @@ func sendInvalidAction(c *Client, message string) error {
 	return BroadcastEvent(EventReceiveInvalidAction, response, []*Client{c})
 }
 
+func sendUpgradeRequired(c *Client, message string) error {
+	response := ReceiveUpgradeRequiredEvent{
+		Message:    message,
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Sent:       time.Now(),
+	}
+	return BroadcastEvent(EventReceiveUpgradeRequired, response, []*Client{c})
+}
+
+// BroadcastGameState sends an event to everyone in the game, building the
+// payload from each recipient's own view of the game state. Clients that
+// opted into deltas get only what changed since the last view they were sent.
+func BroadcastGameState(game *Game, eventType string, build func(state GameState) any) error {
+	game.Seq++
+	for _, client := range game.AllClients() {
+		view := game.ViewFor(client)
+		payload := build(view)
+
+		if client.WantsDeltas() {
+			var changes []StateChange
+			if baseline, exists := game.baselines[client]; exists {
+				changes = DiffGameState(baseline, view)
+			}
+			game.baselines[client] = view
+
+			var err error
+			if payload, err = withStateDelta(payload, game.Seq, changes); err != nil {
+				return err
+			}
+		}
+
+		if err := BroadcastEvent(eventType, payload, []*Client{client}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func BroadcastEvent(eventType string, payload any, clients []*Client) error {
 	data, err := json.Marshal(payload)
 	if err != nil {
@@ -518,7 +1592,7 @@ func BroadcastEvent(eventType string, payload any, clients []*Client) error {
 	}
 	outgoingEvent := Event{Type: eventType, Payload: data}
 	for _, client := range clients {
-		client.egress <- outgoingEvent
+		client.send(outgoingEvent)
 	}
 	return nil
 }
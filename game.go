@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"slices"
 	"sync"
 	"time"
 )
@@ -10,7 +12,9 @@ type Player struct {
 	ID     string       `json:"id"`
 	Color  string       `json:"color"`
 	State  *PlayerState `json:"state"`
-	Client *Client
+	Client *Client      `json:"-"`
+
+	actions actionWindow
 }
 
 type PlayerState struct {
@@ -23,26 +27,54 @@ type PlayerState struct {
 }
 
 type GameState struct {
-	Players map[string]*Player `json:"players"`
-	Status  string             `json:"status"`
+	Players      map[string]*Player `json:"players"`
+	Status       string             `json:"status"`
+	JuryVotes    map[string]string  `json:"juryVotes"`
+	HeartPickups []Hex              `json:"heartPickups"`
+	StormCenter  Hex                `json:"stormCenter"`
+	SafeRadius   int                `json:"safeRadius"`
+	Terrain      []TerrainCell      `json:"terrain"`
+	Alliances    []Alliance         `json:"alliances"`
+	SeriesScore  map[string]int     `json:"seriesScore"`
+
+	RematchRequests   []string           `json:"rematchRequests"`
+	AllianceProposals []AllianceProposal `json:"-"`
 }
 
 type Game struct {
-	ID          string
-	JoinCode    string
-	BoardSize   int
-	MainClient  *Client
-	State       *GameState
-	LastUpdate  time.Time
-	ClockTime   time.Duration
-	ClockTicker *time.Ticker
-	sync.Mutex
+	ID              string
+	JoinCode        string
+	BoardSize       int
+	Terrain         map[Hex]string
+	Settings        GameSettings
+	MainClient      *Client
+	Spectators      ClientList
+	State           *GameState
+	LastUpdate      time.Time
+	ClockTime       time.Duration
+	ClockInterval   time.Duration
+	ClockTicker     *time.Ticker
+	ClockCycles     int
+	Seq             int
+	Journal         *Journal
+	RematchDeadline time.Time
+	ChatHistory     []ChatMessage
+	manager         *Manager
+
+	// the last view sent to each client that opted into state deltas
+	baselines map[*Client]GameState
+
+	commands chan func()
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 func CreateNewPlayer(playerID string, client *Client, game *Game) (*Player, error) {
 	player := NewPlayer()
 	player.ID = playerID
 	player.Client = client
+	player.State.Hearts = game.Settings.StartingHearts
+	player.State.Range = game.Settings.StartingRange
 	return player, nil
 }
 
@@ -64,20 +96,88 @@ func NewPlayerState() *PlayerState {
 }
 
 func NewGame() *Game {
+	settings := DefaultGameSettings()
 	return &Game{
-		State:       NewGameState(),
-		ClockTime:   1 * time.Minute,
-		ClockTicker: nil,
+		State:         NewGameState(),
+		Settings:      settings,
+		Spectators:    make(ClientList),
+		ClockTime:     settings.ClockInterval(),
+		ClockInterval: settings.ClockInterval(),
+		ClockTicker:   nil,
+		Journal:       NewJournal(""),
+		ChatHistory:   []ChatMessage{},
+		baselines:     make(map[*Client]GameState),
+		commands:      make(chan func()),
+		done:          make(chan struct{}),
+	}
+}
+
+func RestoreGame(snapshot GameSnapshot) *Game {
+	game := NewGame()
+	game.ID = snapshot.ID
+	game.JoinCode = snapshot.JoinCode
+	game.BoardSize = snapshot.BoardSize
+	if snapshot.Settings != (GameSettings{}) {
+		game.Settings = snapshot.Settings
+	}
+	game.ClockTime = snapshot.ClockTime
+	game.ClockInterval = snapshot.ClockInterval
+	game.ClockCycles = snapshot.ClockCycles
+	game.Seq = snapshot.Seq
+	game.LastUpdate = snapshot.LastUpdate
+	game.RematchDeadline = snapshot.RematchDeadline
+
+	state := snapshot.State
+	if state.Players == nil {
+		state.Players = make(map[string]*Player)
+	}
+	if state.JuryVotes == nil {
+		state.JuryVotes = make(map[string]string)
+	}
+	if state.HeartPickups == nil {
+		state.HeartPickups = []Hex{}
+	}
+	if state.Terrain == nil {
+		state.Terrain = []TerrainCell{}
+	}
+	if state.Alliances == nil {
+		state.Alliances = []Alliance{}
 	}
+	if state.SeriesScore == nil {
+		state.SeriesScore = make(map[string]int)
+	}
+	if state.RematchRequests == nil {
+		state.RematchRequests = []string{}
+	}
+	state.AllianceProposals = []AllianceProposal{}
+	game.State = &state
+	game.Terrain = TerrainMap(state.Terrain)
+
+	if snapshot.ChatHistory != nil {
+		game.ChatHistory = snapshot.ChatHistory
+	}
+
+	game.Journal = NewJournal(snapshot.ID)
+
+	return game
 }
 
 func NewGameState() *GameState {
 	return &GameState{
-		Players: make(map[string]*Player),
-		Status:  "initialized",
+		Players:      make(map[string]*Player),
+		Status:       "initialized",
+		JuryVotes:    make(map[string]string),
+		HeartPickups: []Hex{},
+		Terrain:      []TerrainCell{},
+		Alliances:    []Alliance{},
+		SeriesScore:  make(map[string]int),
+
+		RematchRequests:   []string{},
+		AllianceProposals: []AllianceProposal{},
 	}
 }
 
+// AllClients returns every connected player and spectator in the game.
 func (g *Game) AllClients() []*Client {
 	clients := []*Client{}
 	for _, player := range g.State.Players {
@@ -85,51 +185,447 @@ func (g *Game) AllClients() []*Client {
 			clients = append(clients, player.Client)
 		}
 	}
+	for spectator := range g.Spectators {
+		clients = append(clients, spectator)
+	}
 	return clients
 }
 
+// UnbindClient detaches a disconnected client from its player so the player
+// can later be resumed from a new connection with send_rejoin_game.
+func (g *Game) UnbindClient(client *Client) {
+	for _, player := range g.State.Players {
+		if player.Client == client {
+			player.Client = nil
+		}
+	}
+	delete(g.Spectators, client)
+	delete(g.baselines, client)
+}
+
+// DetachClient unbinds a client from the game, handing the host role on if
+// it had it. It must be called from the game's loop.
+func (g *Game) DetachClient(client *Client) error {
+	g.UnbindClient(client)
+	client.Bind("", "")
+	if g.MainClient == client {
+		return g.MigrateHost()
+	}
+	return nil
+}
+
+// MigrateHost hands the host role to the player who has been connected the
+// longest and tells everyone about it. The game is left without a host when
+// nobody is connected; the next player to rejoin takes over.
+func (g *Game) MigrateHost() error {
+	var host *Player
+	for _, player := range g.State.Players {
+		if player.Client == nil || player.Client == g.MainClient {
+			continue
+		}
+		if host == nil || player.Client.ConnectedAt.Before(host.Client.ConnectedAt) {
+			host = player
+		}
+	}
+
+	if host == nil {
+		g.MainClient = nil
+		return nil
+	}
+	g.MainClient = host.Client
+
+	for _, recipient := range g.AllClients() {
+		response := ReceiveHostChangedEvent{
+			PlayerID:     host.ID,
+			PlayerColor:  host.Color,
+			IsMainClient: recipient == g.MainClient,
+			Sent:         time.Now(),
+		}
+		if err := BroadcastEvent(EventReceiveHostChanged, response, []*Client{recipient}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AnnounceWinner stops the clock, scores the win and shows everyone the full
+// final state. The game ends in a draw, with no winner color, if nobody is
+// left standing. Players then have until the rematch deadline to opt in.
+func (g *Game) AnnounceWinner() error {
+	g.StopClock()
+	g.State.Status = "finished"
+	g.RematchDeadline = time.Now().Add(rematchWindow)
+
+	// everyone gets the full final state, so deltas start over from it
+	g.Seq++
+	clear(g.baselines)
+
+	winner := g.State.LastPlayerStanding()
+	if winner != nil {
+		g.State.SeriesScore[winner.ID]++
+	}
+
+	response := ReceivePlayerWinEvent{
+		GameID:          g.ID,
+		GameState:       *g.State,
+		RematchDeadline: g.RematchDeadline,
+		Seq:             g.Seq,
+		Sent:            time.Now(),
+	}
+	if winner != nil {
+		response.PlayerColor = winner.Color
+	}
+	return BroadcastEvent(EventReceivePlayerWin, response, g.AllClients())
+}
+
+// RemovePlayer takes a player out of the game for good, along with their
+// alliances and jury votes, and detaches their client.
+func (g *Game) RemovePlayer(player *Player) {
+	if player.State != nil {
+		g.State.EliminatePlayer(player)
+	}
+
+	for voterID, candidateID := range g.State.JuryVotes {
+		if voterID == player.ID || candidateID == player.ID {
+			delete(g.State.JuryVotes, voterID)
+		}
+	}
+
+	g.State.RemovePlayer(player.ID)
+
+	if player.Client != nil {
+		delete(g.baselines, player.Client)
+		player.Client.Bind("", "")
+		player.Client = nil
+	}
+}
+
+// Snapshot copies everything needed to restore the game after a restart.
+// It must be called from the game's loop.
+func (g *Game) Snapshot() GameSnapshot {
+	return GameSnapshot{
+		ID:            g.ID,
+		JoinCode:      g.JoinCode,
+		BoardSize:     g.BoardSize,
+		Settings:      g.Settings,
+		ClockTime:     g.ClockTime,
+		ClockInterval: g.ClockInterval,
+		ClockCycles:   g.ClockCycles,
+		Seq:           g.Seq,
+		LastUpdate:    g.LastUpdate,
+		State:         g.State.Clone(),
+		ChatHistory:   append([]ChatMessage{}, g.ChatHistory...),
+
+		RematchDeadline: g.RematchDeadline,
+	}
+}
+
+// Persist writes a snapshot to the store. It must be called from the game's
+// loop, which keeps writes for a game in order and stops them once RemoveGame
+// has deleted it.
+func (g *Game) Persist(snapshot GameSnapshot) {
+	if g.manager == nil {
+		return
+	}
+	if err := g.manager.store.Save(snapshot); err != nil {
+		log.Printf("failed to save game %s: %v", g.ID, err)
+	}
+}
+
+var (
+	maxSpectators = 32
+	rematchWindow = 30 * time.Second
+)
+
+// HiddenValue replaces a stat in a game state view when the recipient isn't
+// allowed to see it.
+const HiddenValue = -1
+
+// ViewFor is the game state as the given client is allowed to see it. With
+// fog of war on, a living player only sees the players close enough to them,
+// and allies can optionally share what they see. Spectators and eliminated
+// players learn who is still alive, so jurors can vote, but nothing about
+// where they are or how they stand until the game ends. That way nobody can
+// scout for a player from a second tab or over private messages. Hidden
+// stats are redacted for everyone but their owner.
+func (g *Game) ViewFor(client *Client) GameState {
+	view := g.State.Clone()
+	if g.State.Status != "in_progress" {
+		return view
+	}
+
+	var viewer *Player
+	if player, exists := g.State.Players[client.PlayerID()]; exists && player.Client == client {
+		viewer = player
+	}
+
+	if g.Settings.FogOfWar {
+		lookouts := []*Player{}
+		if viewer != nil && viewer.State != nil {
+			lookouts = append(lookouts, viewer)
+		}
+		if len(lookouts) > 0 && g.Settings.AllianceVision {
+			for _, allyID := range g.State.Allies(viewer.ID) {
+				if ally, exists := g.State.Players[allyID]; exists && ally.State != nil {
+					lookouts = append(lookouts, ally)
+				}
+			}
+		}
+
+		for playerID, player := range view.Players {
+			if player.State == nil || g.isSeenBy(player, lookouts) {
+				continue
+			}
+			if len(lookouts) > 0 {
+				delete(view.Players, playerID)
+				continue
+			}
+			player.State.Hearts = HiddenValue
+			player.State.Range = HiddenValue
+			player.State.ActionPoints = HiddenValue
+			player.State.Position = Hex{R: HiddenValue, Q: HiddenValue}
+			player.State.CellsInRange = []Hex{}
+			player.State.CellsAtMaxRange = []Hex{}
+		}
+	}
+
+	for playerID, player := range view.Players {
+		if player.State == nil || (viewer != nil && playerID == viewer.ID) {
+			continue
+		}
+		if g.Settings.HideActionPoints {
+			player.State.ActionPoints = HiddenValue
+		}
+		if g.Settings.HideRange {
+			player.State.Range = HiddenValue
+			player.State.CellsInRange = []Hex{}
+			player.State.CellsAtMaxRange = []Hex{}
+		}
+	}
+	return view
+}
+
+func (g *Game) isSeenBy(player *Player, lookouts []*Player) bool {
+	for _, lookout := range lookouts {
+		if lookout.ID == player.ID {
+			return true
+		}
+		visibleRange := lookout.State.Range + g.Settings.FogOfWarExtraRange
+		if AxialDistance(lookout.State.Position, player.State.Position) <= visibleRange {
+			return true
+		}
+	}
+	return false
+}
+
+// StartClock starts the game clock. Its ticks are handled on the game's loop
+// alongside commands.
 func (g *Game) StartClock() {
+	g.StopClock()
 	g.ClockTicker = time.NewTicker(1 * time.Second)
-	clockTime := g.ClockTime
+}
 
-	go func() {
-		for range g.ClockTicker.C {
-			g.Lock()
+// tickClock counts the clock down by a second, running a cycle whenever it
+// reaches zero.
+func (g *Game) tickClock() {
+	g.ClockTime -= 1 * time.Second
 
-			g.ClockTime -= 1 * time.Second
+	if g.ClockTime <= 0 {
+		g.ClockTime = g.ClockInterval
+		g.ClockCycles++
 
-			if g.ClockTime <= 0 {
-				g.ClockTime = clockTime
+		if g.applyStorm() {
+			g.Record(JournalStorm, "", nil)
 
-				for _, player := range g.State.Players {
-					if player.State != nil {
-						player.State.ActionPoints++
-					}
-				}
+			if err := g.AnnounceWinner(); err != nil {
+				fmt.Printf("failed to broadcast player win: %v", err)
+			}
+			g.manager.archiveGame(g)
+			g.Persist(g.Snapshot())
+			return
+		}
 
-				response := ReceiveActionPointEvent{
-					GameState: *g.State,
-					Sent:      time.Now(),
-				}
+		for _, player := range g.State.Players {
+			if player.State != nil {
+				player.State.ActionPoints++
+			}
+		}
 
-				err := BroadcastEvent(EventReceiveActionPoint, response, g.AllClients())
-				if err != nil {
-					fmt.Printf("failed to broadcast action points: %v", err)
-				}
+		g.spawnHeartPickup()
+
+		votes, juryWinner := g.State.TallyJuryVotes()
+		if juryWinner != nil {
+			juryWinner.State.ActionPoints++
+		}
+
+		err := BroadcastGameState(g, EventReceiveActionPoint, func(state GameState) any {
+			return ReceiveActionPointEvent{
+				GameState: state,
+				Sent:      time.Now(),
 			}
+		})
+		if err != nil {
+			fmt.Printf("failed to broadcast action points: %v", err)
+		}
 
-			response := ReceiveClockUpdateEvent{
-				Seconds: int(g.ClockTime.Seconds()),
-				Sent:    time.Now(),
+		if len(votes) > 0 {
+			juryColor := ""
+			if juryWinner != nil {
+				juryColor = juryWinner.Color
 			}
 
-			err := BroadcastEvent(EventReceiveClockUpdate, response, g.AllClients())
+			err := BroadcastGameState(g, EventReceiveJuryResults, func(state GameState) any {
+				return ReceiveJuryResultsEvent{
+					GameState:   state,
+					Votes:       votes,
+					PlayerColor: juryColor,
+					Sent:        time.Now(),
+				}
+			})
 			if err != nil {
-				fmt.Printf("failed to broadcast clock update: %v", err)
+				fmt.Printf("failed to broadcast jury results: %v", err)
 			}
-			g.Unlock()
 		}
-	}()
+
+		g.State.JuryVotes = make(map[string]string)
+
+		g.Record(JournalActionPoints, "", nil)
+		g.Persist(g.Snapshot())
+	}
+
+	response := ReceiveClockUpdateEvent{
+		Seconds: int(g.ClockTime.Seconds()),
+		Sent:    time.Now(),
+	}
+
+	err := BroadcastEvent(EventReceiveClockUpdate, response, g.AllClients())
+	if err != nil {
+		fmt.Printf("failed to broadcast clock update: %v", err)
+	}
+}
+
+// run is the game's loop. Commands and clock ticks are handled one at a time,
+// so nothing else ever touches the game's state.
+func (g *Game) run() {
+	for {
+		select {
+		case <-g.done:
+			return
+		default:
+		}
+
+		var tick <-chan time.Time
+		if g.ClockTicker != nil {
+			tick = g.ClockTicker.C
+		}
+
+		select {
+		case command := <-g.commands:
+			command()
+		case <-tick:
+			g.tickClock()
+		case <-g.done:
+			return
+		}
+	}
+}
+
+// Do runs a command on the game's loop and waits for its result. It must not
+// be called from the game's own loop.
+func (g *Game) Do(command func() error) error {
+	result := make(chan error, 1)
+	select {
+	case g.commands <- func() { result <- command() }:
+		return <-result
+	case <-g.done:
+		return errGameNotFound
+	}
+}
+
+// Stop ends the game's loop once the current command returns. It must be
+// called from the loop.
+func (g *Game) Stop() {
+	g.stopOnce.Do(func() {
+		g.StopClock()
+		close(g.done)
+	})
+}
+
+// applyStorm damages every player caught outside the safe area, then shrinks
+// the safe area every StormInterval cycles. It reports whether the storm left
+// at most one player standing.
+func (g *Game) applyStorm() bool {
+	if !g.Settings.StormEnabled {
+		return false
+	}
+
+	for _, player := range g.State.Players {
+		if player.State == nil || g.IsHexSafe(player.State.Position) {
+			continue
+		}
+		player.State.Hearts -= 1
+		if player.State.Hearts <= 0 {
+			g.State.EliminatePlayer(player)
+		}
+	}
+
+	if g.ClockCycles%g.Settings.StormInterval == 0 && g.State.SafeRadius > 0 {
+		g.State.SafeRadius -= 1
+
+		pickups := []Hex{}
+		for _, pickup := range g.State.HeartPickups {
+			if g.IsHexSafe(pickup) {
+				pickups = append(pickups, pickup)
+			}
+		}
+		g.State.HeartPickups = pickups
+	}
+
+	return g.State.LivingPlayerCount() <= 1
+}
+
+// IsHexSafe reports whether a cell is outside the storm. Every cell on the
+// board is safe when storm mode is off.
+func (g *Game) IsHexSafe(hex Hex) bool {
+	if !g.Settings.StormEnabled {
+		return true
+	}
+	return AxialDistance(hex, g.State.StormCenter) <= g.State.SafeRadius
+}
+
+// IsHexPlayable reports whether a player may move onto a cell.
+func (g *Game) IsHexPlayable(hex Hex) bool {
+	return isHexOnBoard(hex, g.BoardSize) && g.IsHexSafe(hex) && g.Terrain[hex] != TerrainWall
+}
+
+// RandomPlayablePosition picks an unoccupied playable cell without a pickup.
+func (g *Game) RandomPlayablePosition() (Hex, bool) {
+	candidates := []Hex{}
+	for _, hex := range AxialSpiral(g.BoardSize, g.State.StormCenter, g.BoardSize/2) {
+		if g.IsHexPlayable(hex) && g.State.GetPlayerAtCell(hex) == nil && !slices.Contains(g.State.HeartPickups, hex) {
+			candidates = append(candidates, hex)
+		}
+	}
+	if len(candidates) == 0 {
+		return Hex{}, false
+	}
+	return candidates[getRandomInt(0, len(candidates))], true
+}
+
+func (g *Game) spawnHeartPickup() {
+	interval := g.Settings.HeartSpawnInterval
+	if interval == 0 || g.ClockCycles%interval != 0 {
+		return
+	}
+
+	// keep the board from filling up with hearts in a long game
+	if len(g.State.HeartPickups) >= g.State.LivingPlayerCount() {
+		return
+	}
+
+	if position, ok := g.RandomPlayablePosition(); ok {
+		g.State.HeartPickups = append(g.State.HeartPickups, position)
+	}
 }
 
 func (g *Game) StopClock() {
@@ -139,6 +635,44 @@ func (g *Game) StopClock() {
 	}
 }
 
+func (gs *GameState) Clone() GameState {
+	clone := GameState{
+		Players:      make(map[string]*Player, len(gs.Players)),
+		Status:       gs.Status,
+		JuryVotes:    make(map[string]string, len(gs.JuryVotes)),
+		HeartPickups: append([]Hex{}, gs.HeartPickups...),
+		StormCenter:  gs.StormCenter,
+		SafeRadius:   gs.SafeRadius,
+		Terrain:      gs.Terrain,
+		Alliances:    append([]Alliance{}, gs.Alliances...),
+		SeriesScore:  make(map[string]int, len(gs.SeriesScore)),
+
+		RematchRequests:   append([]string{}, gs.RematchRequests...),
+		AllianceProposals: append([]AllianceProposal{}, gs.AllianceProposals...),
+	}
+	for playerID, player := range gs.Players {
+		clone.Players[playerID] = player.Clone()
+	}
+	for voterID, candidateID := range gs.JuryVotes {
+		clone.JuryVotes[voterID] = candidateID
+	}
+	for playerID, wins := range gs.SeriesScore {
+		clone.SeriesScore[playerID] = wins
+	}
+	return clone
+}
+
+func (p *Player) Clone() *Player {
+	clone := *p
+	if p.State != nil {
+		state := *p.State
+		state.CellsInRange = append([]Hex{}, p.State.CellsInRange...)
+		state.CellsAtMaxRange = append([]Hex{}, p.State.CellsAtMaxRange...)
+		clone.State = &state
+	}
+	return &clone
+}
+
 func (gs *GameState) AddPlayer(player *Player) {
 	gs.Players[player.ID] = player
 }
@@ -159,14 +693,67 @@ func (gs *GameState) GetPlayerAtCell(hex Hex) *Player {
 	return nil
 }
 
-func (gs *GameState) CheckForWinner() bool {
+func (gs *GameState) LivingPlayerCount() int {
 	playerCount := 0
 	for _, player := range gs.Players {
 		if player.State != nil {
 			playerCount += 1
 		}
 	}
-	return playerCount == 1
+	return playerCount
+}
+
+func (gs *GameState) LastPlayerStanding() *Player {
+	if gs.LivingPlayerCount() != 1 {
+		return nil
+	}
+	for _, player := range gs.Players {
+		if player.State != nil {
+			return player
+		}
+	}
+	return nil
+}
+
+func (gs *GameState) CheckForWinner() bool {
+	return gs.LivingPlayerCount() == 1
+}
+
+// TakeHeartPickup removes the heart pickup at the given cell, if there is one.
+func (gs *GameState) TakeHeartPickup(hex Hex) bool {
+	for i, pickup := range gs.HeartPickups {
+		if pickup == hex {
+			gs.HeartPickups = append(gs.HeartPickups[:i], gs.HeartPickups[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// TallyJuryVotes counts the votes cast by eliminated players this clock cycle.
+// Votes for players who have since been eliminated are discarded. The winner
+// is the living player with strictly the most votes; a tie has no winner.
+func (gs *GameState) TallyJuryVotes() (map[string]int, *Player) {
+	votes := make(map[string]int)
+	for _, candidateID := range gs.JuryVotes {
+		candidate, exists := gs.Players[candidateID]
+		if !exists || candidate.State == nil {
+			continue
+		}
+		votes[candidateID]++
+	}
+
+	var winner *Player
+	most := 0
+	for candidateID, count := range votes {
+		if count > most {
+			winner = gs.Players[candidateID]
+			most = count
+		} else if count == most {
+			winner = nil
+		}
+	}
+	return votes, winner
 }
 
 func (ps *PlayerState) IsCellInRange(hex Hex) bool {
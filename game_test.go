@@ -0,0 +1,194 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// newViewTestGame sets up a game in progress on a 9x9 board. Alice and Bob
+// are neighbors in the middle, Carol and Erin are together in a far corner
+// and Dave has been eliminated. With the default extra range, Alice can see
+// three cells out.
+func newViewTestGame(settings GameSettings) (*Game, map[string]*Client) {
+	game := NewGame()
+	game.ID = "game-test"
+	game.BoardSize = 9
+	game.Settings = settings
+	game.State.Status = "in_progress"
+
+	positions := map[string]Hex{
+		"alice": {R: 4, Q: 4},
+		"bob":   {R: 4, Q: 5},
+		"carol": {R: 0, Q: 8},
+		"erin":  {R: 0, Q: 7},
+	}
+
+	clients := map[string]*Client{}
+	for _, playerID := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		client := &Client{}
+		client.Bind(game.ID, playerID)
+		clients[playerID] = client
+
+		player, _ := CreateNewPlayer(playerID, client, game)
+		if position, alive := positions[playerID]; alive {
+			player.State.Position = position
+			player.State.ActionPoints = 3
+			player.State.CellsInRange = []Hex{position}
+			player.State.CellsAtMaxRange = []Hex{position}
+		} else {
+			player.State = nil
+		}
+		game.State.AddPlayer(player)
+	}
+
+	spectator := &Client{}
+	spectator.Bind(game.ID, "")
+	game.Spectators[spectator] = true
+	clients["spectator"] = spectator
+
+	return game, clients
+}
+
+func TestViewForFogOfWar(t *testing.T) {
+	hidden := Hex{R: HiddenValue, Q: HiddenValue}
+	tests := []struct {
+		name           string
+		fog            bool
+		allianceVision bool
+		viewer         string
+
+		// players in the view with their real position, and living players
+		// listed with their position hidden
+		visible  []string
+		redacted []string
+	}{
+		{
+			name:    "no fog",
+			viewer:  "alice",
+			visible: []string{"alice", "bob", "carol", "erin"},
+		},
+		{
+			name:    "living viewer",
+			fog:     true,
+			viewer:  "alice",
+			visible: []string{"alice", "bob"},
+		},
+		{
+			name:           "ally shares vision",
+			fog:            true,
+			allianceVision: true,
+			viewer:         "alice",
+			visible:        []string{"alice", "bob", "carol", "erin"},
+		},
+		{
+			name:    "ally without shared vision",
+			fog:     true,
+			viewer:  "alice",
+			visible: []string{"alice", "bob"},
+		},
+		{
+			name:     "eliminated viewer",
+			fog:      true,
+			viewer:   "dave",
+			redacted: []string{"alice", "bob", "carol", "erin"},
+		},
+		{
+			name:     "spectator",
+			fog:      true,
+			viewer:   "spectator",
+			redacted: []string{"alice", "bob", "carol", "erin"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := DefaultGameSettings()
+			settings.FogOfWar = test.fog
+			settings.AllianceVision = test.allianceVision
+			game, clients := newViewTestGame(settings)
+			game.State.AddAlliance("alice", "carol")
+
+			view := game.ViewFor(clients[test.viewer])
+
+			// eliminated players are never hidden
+			if player, exists := view.Players["dave"]; !exists || player.State != nil {
+				t.Errorf("eliminated player missing from view")
+			}
+
+			living := []string{}
+			for playerID, player := range view.Players {
+				if player.State != nil {
+					living = append(living, playerID)
+				}
+			}
+			want := append(slices.Clone(test.visible), test.redacted...)
+			slices.Sort(living)
+			slices.Sort(want)
+			if !slices.Equal(living, want) {
+				t.Fatalf("living players in view = %v, want %v", living, want)
+			}
+
+			for _, playerID := range test.visible {
+				if got := view.Players[playerID].State.Position; got != game.State.Players[playerID].State.Position {
+					t.Errorf("%s at %v, want %v", playerID, got, game.State.Players[playerID].State.Position)
+				}
+			}
+			for _, playerID := range test.redacted {
+				state := view.Players[playerID].State
+				if state.Position != hidden || state.Hearts != HiddenValue || state.Range != HiddenValue ||
+					state.ActionPoints != HiddenValue || len(state.CellsInRange) != 0 {
+					t.Errorf("%s not redacted: %+v", playerID, state)
+				}
+			}
+		})
+	}
+}
+
+func TestViewForHiddenStats(t *testing.T) {
+	settings := DefaultGameSettings()
+	settings.HideActionPoints = true
+	settings.HideRange = true
+	game, clients := newViewTestGame(settings)
+
+	view := game.ViewFor(clients["alice"])
+
+	owner := view.Players["alice"].State
+	if owner.ActionPoints != 3 || owner.Range != settings.StartingRange || len(owner.CellsInRange) == 0 {
+		t.Errorf("owner's own stats redacted: %+v", owner)
+	}
+
+	for _, playerID := range []string{"bob", "carol", "erin"} {
+		other := view.Players[playerID].State
+		if other.ActionPoints != HiddenValue || other.Range != HiddenValue ||
+			len(other.CellsInRange) != 0 || len(other.CellsAtMaxRange) != 0 {
+			t.Errorf("%s's stats not redacted: %+v", playerID, other)
+		}
+		if other.Hearts != settings.StartingHearts {
+			t.Errorf("%s's hearts = %d, want %d", playerID, other.Hearts, settings.StartingHearts)
+		}
+	}
+
+	// the view is a copy, so redacting it leaves the game alone
+	if game.State.Players["bob"].State.ActionPoints != 3 {
+		t.Errorf("ViewFor changed the game state")
+	}
+}
+
+func TestViewForNotInProgress(t *testing.T) {
+	settings := DefaultGameSettings()
+	settings.FogOfWar = true
+	settings.HideActionPoints = true
+	game, clients := newViewTestGame(settings)
+	game.State.Status = "finished"
+
+	view := game.ViewFor(clients["spectator"])
+	for playerID, player := range game.State.Players {
+		if player.State == nil {
+			continue
+		}
+		state := view.Players[playerID].State
+		if state.Position != player.State.Position || state.ActionPoints != player.State.ActionPoints {
+			t.Errorf("%s redacted after the game ended: %+v", playerID, state)
+		}
+	}
+}
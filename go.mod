@@ -5,6 +5,9 @@ go 1.23.4
 require github.com/gorilla/websocket v1.5.3
 
 require (
+	github.com/fxamacker/cbor/v2 v2.9.0
 	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
 )
+
+require github.com/x448/float16 v0.8.4 // indirect
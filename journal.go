@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	JournalStart           = "start"
+	JournalMove            = "move"
+	JournalShoot           = "shoot"
+	JournalIncreaseRange   = "increase_range"
+	JournalGiveActionPoint = "give_action_point"
+	JournalActionPoints    = "action_points"
+	JournalStorm           = "storm"
+	JournalLeave           = "leave"
+)
+
+type JournalEntry struct {
+	Seq      int       `json:"seq"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	PlayerID string    `json:"playerID,omitempty"`
+	Hex      *Hex      `json:"hex,omitempty"`
+	State    GameState `json:"state"`
+}
+
+// Journal is the append-only log of every accepted action in a game. Each
+// entry carries a compact copy of the state after the action, so a finished
+// game can be played back without re-running the rules. Cells in range are
+// left out since they follow from each player's position and range.
+type Journal struct {
+	GameID  string         `json:"gameID"`
+	Entries []JournalEntry `json:"entries"`
+}
+
+func NewJournal(gameID string) *Journal {
+	return &Journal{
+		GameID:  gameID,
+		Entries: []JournalEntry{},
+	}
+}
+
+func (j *Journal) Record(entryType string, playerID string, hex *Hex, state GameState) JournalEntry {
+	entry := JournalEntry{
+		Seq:      len(j.Entries) + 1,
+		Time:     time.Now(),
+		Type:     entryType,
+		PlayerID: playerID,
+		Hex:      hex,
+		State:    state,
+	}
+	j.Entries = append(j.Entries, entry)
+	return entry
+}
+
+// Record journals an action against the game's current state and appends it
+// to the game's log in the store. It must be called from the game's loop.
+func (g *Game) Record(entryType string, playerID string, hex *Hex) {
+	entry := g.Journal.Record(entryType, playerID, hex, g.State.Compact())
+	if g.manager == nil {
+		return
+	}
+	if err := g.manager.store.AppendJournal(g.ID, entry); err != nil {
+		log.Printf("failed to journal game %s: %v", g.ID, err)
+	}
+}
+
+// Compact clones the state without each player's cells in range, which make
+// up most of its size.
+func (gs *GameState) Compact() GameState {
+	compact := gs.Clone()
+	for _, player := range compact.Players {
+		if player.State != nil {
+			player.State.CellsInRange = []Hex{}
+			player.State.CellsAtMaxRange = []Hex{}
+		}
+	}
+	return compact
+}
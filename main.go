@@ -23,10 +23,24 @@ func main() {
 func setupAPI() {
 	ctx := context.Background()
 
-	manager := NewManager(ctx)
+	storeDir := goDotEnvVariable("GAME_STORE_DIR")
+	if storeDir == "" {
+		storeDir = "data/games"
+	}
+
+	store, err := NewFileGameStore(storeDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	manager := NewManager(ctx, store)
+	if secret := goDotEnvVariable("TOKEN_SECRET"); secret != "" {
+		manager.tokenSecret = []byte(secret)
+	}
 
 	http.Handle("/", http.FileServer(http.Dir("./web/dist")))
 	http.HandleFunc("/ws", manager.serveWS)
+	http.HandleFunc("GET /replay/{gameID}", manager.serveReplay)
 }
 
 func goDotEnvVariable(key string) string {
@@ -2,9 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
@@ -14,6 +20,7 @@ import (
 var websocketUpgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    codecSubprotocols,
 }
 
 type Manager struct {
@@ -22,16 +29,28 @@ type Manager struct {
 
 	handlers map[string]EventHandler
 	games    map[string]*Game
+	store    GameStore
+
+	tokenSecret []byte
 }
 
-func NewManager(ctx context.Context) *Manager {
+func NewManager(ctx context.Context, store GameStore) *Manager {
 	m := &Manager{
 		clients:  make(ClientList),
 		handlers: make(map[string]EventHandler),
 		games:    make(map[string]*Game),
+		store:    store,
 	}
 
+	secret, err := store.TokenSecret()
+	if err != nil {
+		log.Printf("WARNING: %v; using a temporary secret, so players can't rejoin restored games after a restart", err)
+		secret = NewTokenSecret()
+	}
+	m.tokenSecret = secret
+
 	m.setupEventHandlers()
+	m.restoreGames()
 
 	go m.startGameCleanupRoutine()
 
@@ -39,6 +58,7 @@ func NewManager(ctx context.Context) *Manager {
 }
 
 func (m *Manager) setupEventHandlers() {
+	m.handlers[EventSendHello] = HelloHandler
 	m.handlers[EventSendInitializeGame] = InitializeGameHandler
 	m.handlers[EventSendJoinGame] = JoinGameHandler
 	m.handlers[EventSendStartGame] = StartGameHandler
@@ -46,15 +66,55 @@ func (m *Manager) setupEventHandlers() {
 	m.handlers[EventSendPlayerShoot] = PlayerShootHandler
 	m.handlers[EventSendPlayerIncreaseRange] = PlayerIncreaseRangeHandler
 	m.handlers[EventSendPlayerGiveActionPoint] = PlayerGiveActionPointHandler
+	m.handlers[EventSendJuryVote] = JuryVoteHandler
+	m.handlers[EventSendRejoinGame] = RejoinGameHandler
+	m.handlers[EventSendRequestReplay] = RequestReplayHandler
+	m.handlers[EventSendUpdateSettings] = UpdateSettingsHandler
+	m.handlers[EventSendSpectateGame] = SpectateGameHandler
+	m.handlers[EventSendChatMessage] = ChatMessageHandler
+	m.handlers[EventSendPrivateMessage] = PrivateMessageHandler
+	m.handlers[EventSendProposeAlliance] = ProposeAllianceHandler
+	m.handlers[EventSendAcceptAlliance] = AcceptAllianceHandler
+	m.handlers[EventSendBreakAlliance] = BreakAllianceHandler
+	m.handlers[EventSendLeaveGame] = LeaveGameHandler
+	m.handlers[EventSendKickPlayer] = KickPlayerHandler
+	m.handlers[EventSendRequestRematch] = RequestRematchHandler
+	m.handlers[EventSendRequestSnapshot] = RequestSnapshotHandler
 }
 
 func (m *Manager) routeEvent(event Event, c *Client) error {
+	if event.Type != EventSendHello && c.protocolVersion < MinProtocolVersion {
+		return sendUpgradeRequired(c, "Please reload to get the latest version of the game")
+	}
+
 	if handler, ok := m.handlers[event.Type]; ok {
-		if err := handler(event, c); err != nil {
+		if event.ID != "" && m.isDuplicateAction(c, event.ID) {
+			return sendAck(c, event.ID, true)
+		}
+
+		err := handler(event, c)
+		if err != nil {
+			if sendErr := sendError(c, event, err); sendErr != nil {
+				return sendErr
+			}
+		} else {
+			m.saveGame(c.GameID())
+		}
+		if event.ID != "" {
+			if ackErr := sendAck(c, event.ID, false); ackErr != nil {
+				return ackErr
+			}
+		}
+
+		var actionErr *ActionError
+		if err != nil && !errors.As(err, &actionErr) {
 			return err
 		}
 		return nil
 	} else {
+		if err := sendUpgradeRequired(c, fmt.Sprintf("Unknown event %q, please reload to get the latest version of the game", event.Type)); err != nil {
+			return err
+		}
 		return errors.New("there is no such event type")
 	}
 }
@@ -68,7 +128,10 @@ func (m *Manager) serveWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := NewClient(conn, m)
+	client := NewClient(conn, m, NegotiateCodec(conn, r))
+	if r.URL.Query().Get("deltas") == "1" {
+		client.EnableDeltas()
+	}
 
 	m.addClient(client)
 
@@ -76,6 +139,32 @@ func (m *Manager) serveWS(w http.ResponseWriter, r *http.Request) {
 	go client.writeMessages()
 }
 
+func (m *Manager) serveReplay(w http.ResponseWriter, r *http.Request) {
+	journal, err := m.store.LoadReplay(r.PathValue("gameID"))
+	if errors.Is(err, ErrReplayNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to load replay", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(journal); err != nil {
+		log.Println(err)
+	}
+}
+
+func (m *Manager) hasClient(client *Client) bool {
+	m.RLock()
+	defer m.RUnlock()
+
+	_, ok := m.clients[client]
+	return ok
+}
+
 func (m *Manager) addClient(client *Client) {
 	m.Lock()
 	defer m.Unlock()
@@ -85,52 +174,349 @@ func (m *Manager) addClient(client *Client) {
 
 func (m *Manager) removeClient(client *Client) {
 	m.Lock()
-	defer m.Unlock()
-
-	if _, ok := m.clients[client]; ok {
+	_, ok := m.clients[client]
+	if ok {
 		client.connection.Close()
+		client.closeEgress()
 		delete(m.clients, client)
 	}
+	m.Unlock()
+
+	if !ok {
+		return
+	}
+
+	m.detachClient(client)
+}
+
+// detachClient unbinds a client from the game it is in, leaving its player to
+// be resumed later. It must not be called from a game's loop.
+func (m *Manager) detachClient(client *Client) {
+	game, err := m.GetGame(client.GameID())
+	if err != nil {
+		return
+	}
+	err = game.Do(func() error {
+		return game.DetachClient(client)
+	})
+	if err != nil && !errors.Is(err, errGameNotFound) {
+		log.Printf("failed to migrate host: %v", err)
+	}
 }
 
 func (m *Manager) startGameCleanupRoutine() {
 	for {
 		time.Sleep(1 * time.Minute)
 
-		m.Lock()
-		games := make(map[string]*Game, len(m.games))
-		for gameID, game := range m.games {
-			games[gameID] = game
-		}
-		m.Unlock()
-
-		for gameID, game := range games {
-			game.Lock()
-			if game.State != nil && game.State.Status == "initialized" &&
-				time.Since(game.LastUpdate) >= 5*time.Minute {
-				log.Printf("Deleting game: %s (Last updated: %v)", gameID, game.LastUpdate)
-				game.Unlock()
-
-				m.Lock()
-				delete(m.games, gameID)
-				m.Unlock()
-			} else if game.State != nil && game.State.Status == "in_progress" && time.Since(game.LastUpdate) >= 10*time.Minute {
-				log.Printf("Deleting game: %s (Last updated: %v)", gameID, game.LastUpdate)
-				game.Unlock()
-
-				m.Lock()
-				delete(m.games, gameID)
-				m.Unlock()
-			} else {
-				game.Unlock()
-			}
+		m.RLock()
+		games := make([]*Game, 0, len(m.games))
+		for _, game := range m.games {
+			games = append(games, game)
+		}
+		m.RUnlock()
+
+		for _, game := range games {
+			game.Do(func() error {
+				if game.State.Status == "initialized" && time.Since(game.LastUpdate) >= 5*time.Minute ||
+					game.State.Status == "in_progress" && time.Since(game.LastUpdate) >= 10*time.Minute {
+					log.Printf("Deleting game: %s (Last updated: %v)", game.ID, game.LastUpdate)
+					m.RemoveGame(game.ID)
+				}
+				return nil
+			})
+		}
+	}
+}
+
+// GetGame looks up a game by its ID.
+func (m *Manager) GetGame(gameID string) (*Game, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	game, exists := m.games[gameID]
+	if !exists {
+		return nil, errGameNotFound
+	}
+	return game, nil
+}
+
+// FindGame looks up a game by its join code.
+func (m *Manager) FindGame(joinCode string) (*Game, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, game := range m.games {
+		if game.JoinCode == joinCode {
+			return game, nil
+		}
+	}
+	return nil, newActionError(ErrorGameNotFound, "Join code not found")
+}
+
+// FindGameForToken looks up the game a player's rejoin token was issued for.
+func (m *Manager) FindGameForToken(playerID, token string) (*Game, error) {
+	m.RLock()
+	defer m.RUnlock()
+
+	for _, game := range m.games {
+		if m.VerifyPlayerToken(game.ID, playerID, token) {
+			return game, nil
 		}
 	}
+	return nil, errGameNotFound
 }
 
+// RemoveGame unregisters a game and stops its loop. It must be called from
+// the game's loop.
 func (m *Manager) RemoveGame(gameID string) {
-	_, exists := m.games[gameID]
+	m.Lock()
+	game, exists := m.games[gameID]
 	if exists {
 		delete(m.games, gameID)
 	}
+	m.Unlock()
+
+	if exists {
+		game.Stop()
+	}
+
+	if err := m.store.Delete(gameID); err != nil {
+		log.Println(err)
+	}
+}
+
+// AddGame registers a game with the manager and starts its loop.
+func (m *Manager) AddGame(game *Game) {
+	game.manager = m
+
+	m.Lock()
+	m.games[game.ID] = game
+	m.Unlock()
+
+	go game.run()
+}
+
+// removePlayer handles a player leaving or being kicked. It must be called
+// from the game's loop.
+func (m *Manager) removePlayer(game *Game, player *Player) error {
+	client := player.Client
+	game.RemovePlayer(player)
+	game.LastUpdate = time.Now()
+
+	if len(game.State.Players) == 0 {
+		m.RemoveGame(game.ID)
+		return nil
+	}
+
+	if client != nil && client == game.MainClient {
+		if err := game.MigrateHost(); err != nil {
+			return err
+		}
+	}
+
+	err := BroadcastGameState(game, EventReceivePlayerLeft, func(state GameState) any {
+		return ReceivePlayerLeftEvent{
+			PlayerID:    player.ID,
+			PlayerColor: player.Color,
+			PlayerCount: len(game.State.Players),
+			GameState:   state,
+			Sent:        time.Now(),
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if game.State.Status != "in_progress" {
+		return nil
+	}
+
+	game.Record(JournalLeave, player.ID, nil)
+
+	if game.State.CheckForWinner() {
+		if err := game.AnnounceWinner(); err != nil {
+			return err
+		}
+		m.archiveGame(game)
+	}
+	return nil
+}
+
+// archiveGame saves a finished game's replay and keeps its lobby open until
+// the rematch deadline. It must be called from the game's loop.
+func (m *Manager) archiveGame(game *Game) {
+	if err := m.store.SaveReplay(game.Journal); err != nil {
+		log.Println(err)
+	}
+	m.scheduleRematch(game)
+}
+
+func (m *Manager) scheduleRematch(game *Game) {
+	time.AfterFunc(time.Until(game.RematchDeadline), func() {
+		m.startRematch(game)
+	})
+}
+
+// startRematch moves the players who asked for a rematch into a fresh lobby
+// with the same join code, settings and host, carrying the series score
+// forward. Everyone else is told they were dropped from the game.
+func (m *Manager) startRematch(finished *Game) {
+	err := finished.Do(func() error {
+		m.RemoveGame(finished.ID)
+
+		players := []*Player{}
+		for _, player := range finished.State.Players {
+			if player.Client == nil {
+				continue
+			}
+			if !slices.Contains(finished.State.RematchRequests, player.ID) {
+				dropFromRematch(finished, player.Client)
+				continue
+			}
+			players = append(players, player)
+		}
+
+		if len(players) == 0 {
+			for spectator := range finished.Spectators {
+				dropFromRematch(finished, spectator)
+			}
+			return nil
+		}
+
+		game := NewGame()
+		game.ID = NewGameID()
+		game.JoinCode = finished.JoinCode
+		game.Settings = finished.Settings
+		game.ClockTime = finished.Settings.ClockInterval()
+		game.ClockInterval = finished.Settings.ClockInterval()
+		game.Journal = NewJournal(game.ID)
+		game.LastUpdate = time.Now()
+		for playerID, wins := range finished.State.SeriesScore {
+			game.State.SeriesScore[playerID] = wins
+		}
+		m.AddGame(game)
+
+		return game.Do(func() error {
+			for _, player := range players {
+				rematchPlayer, err := CreateNewPlayer(player.ID, player.Client, game)
+				if err != nil {
+					log.Printf("failed to create player: %v", err)
+					continue
+				}
+				rematchPlayer.Color = player.Color
+				game.State.AddPlayer(rematchPlayer)
+
+				player.Client.Bind(game.ID, player.ID)
+				if player.Client == finished.MainClient {
+					game.MainClient = player.Client
+				}
+			}
+
+			for spectator := range finished.Spectators {
+				spectator.Bind(game.ID, "")
+				game.Spectators[spectator] = true
+			}
+
+			if game.MainClient == nil {
+				if err := game.MigrateHost(); err != nil {
+					log.Printf("failed to migrate host: %v", err)
+				}
+			}
+
+			for _, client := range game.AllClients() {
+				response := ReceiveRematchEvent{
+					JoinCode:     game.JoinCode,
+					PlayerCount:  len(game.State.Players),
+					IsMainClient: client == game.MainClient,
+					Settings:     game.Settings,
+					GameState:    game.ViewFor(client),
+					Sent:         time.Now(),
+				}
+				if !game.Spectators[client] {
+					response.PlayerID = client.PlayerID()
+					response.Token = m.SignPlayerToken(game.ID, client.PlayerID())
+				}
+				if err := BroadcastEvent(EventReceiveRematch, response, []*Client{client}); err != nil {
+					log.Printf("failed to send rematch: %v", err)
+				}
+			}
+
+			game.Persist(game.Snapshot())
+			log.Printf("Started rematch: %s (was %s)", game.ID, finished.ID)
+			return nil
+		})
+	})
+	if err != nil && !errors.Is(err, errGameNotFound) {
+		log.Printf("failed to start rematch: %v", err)
+	}
+}
+
+// dropFromRematch detaches a client that isn't coming along to a rematch and
+// tells it the finished game is gone.
+func dropFromRematch(finished *Game, client *Client) {
+	client.Bind("", "")
+
+	response := ReceiveKickedEvent{
+		JoinCode: finished.JoinCode,
+		Reason:   KickedNoRematch,
+		Sent:     time.Now(),
+	}
+	if err := BroadcastEvent(EventReceiveKicked, response, []*Client{client}); err != nil {
+		log.Printf("failed to send kicked: %v", err)
+	}
+}
+
+// saveGame persists a game from its loop, so snapshots are written in order
+// and never after the game has been removed.
+func (m *Manager) saveGame(gameID string) {
+	game, err := m.GetGame(gameID)
+	if err != nil {
+		return
+	}
+
+	game.Do(func() error {
+		game.Persist(game.Snapshot())
+		return nil
+	})
+}
+
+func (m *Manager) restoreGames() {
+	snapshots, err := m.store.LoadAll()
+	if err != nil {
+		log.Printf("failed to restore games: %v", err)
+		return
+	}
+
+	for _, snapshot := range snapshots {
+		game := RestoreGame(snapshot)
+		if journal, err := m.store.LoadJournal(game.ID); err != nil {
+			log.Println(err)
+		} else {
+			game.Journal = journal
+		}
+		// give players time to reconnect before the cleanup routine runs
+		game.LastUpdate = time.Now()
+
+		switch game.State.Status {
+		case "in_progress":
+			game.StartClock()
+		case "finished":
+			m.scheduleRematch(game)
+		}
+		m.AddGame(game)
+		log.Printf("Restored game: %s (%s)", game.ID, game.State.Status)
+	}
+}
+
+// SignPlayerToken issues the token a client presents to prove it owns a
+// player, e.g. when rejoining after a dropped connection.
+func (m *Manager) SignPlayerToken(gameID, playerID string) string {
+	mac := hmac.New(sha256.New, m.tokenSecret)
+	mac.Write([]byte(gameID + ":" + playerID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *Manager) VerifyPlayerToken(gameID, playerID, token string) bool {
+	expected := m.SignPlayerToken(gameID, playerID)
+	return hmac.Equal([]byte(expected), []byte(token))
 }
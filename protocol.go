@@ -0,0 +1,47 @@
+package main
+
+import (
+	"slices"
+)
+
+// ProtocolVersion is the version of the websocket protocol this server
+// speaks. Clients that never send hello are from before the handshake
+// existed and count as version 1.
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 1
+	legacyVersion      = 1
+
+	// clients at this version get receive_error instead of free-text errors
+	structuredErrorsVersion = 2
+	// clients at this version always get a player ID issued by the server
+	serverIssuedIDsVersion = 2
+)
+
+// Capabilities a client can ask for in its hello.
+const (
+	CapabilityDeltas = "deltas"
+)
+
+var serverCapabilities = []string{CapabilityDeltas}
+
+// negotiateCapabilities keeps the capabilities both sides support.
+func negotiateCapabilities(requested []string) []string {
+	agreed := []string{}
+	for _, capability := range requested {
+		if slices.Contains(serverCapabilities, capability) && !slices.Contains(agreed, capability) {
+			agreed = append(agreed, capability)
+		}
+	}
+	return agreed
+}
+
+// supportedEvents lists the event types the server accepts from clients.
+func (m *Manager) supportedEvents() []string {
+	events := make([]string, 0, len(m.handlers))
+	for eventType := range m.handlers {
+		events = append(events, eventType)
+	}
+	slices.Sort(events)
+	return events
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type GameSettings struct {
+	StartingHearts      int  `json:"startingHearts"`
+	StartingRange       int  `json:"startingRange"`
+	ActionPointInterval int  `json:"actionPointInterval"`
+	MaxPlayers          int  `json:"maxPlayers"`
+	BoardSizeMultiplier int  `json:"boardSizeMultiplier"`
+	RangeUpgradeCost    int  `json:"rangeUpgradeCost"`
+	HeartSpawnInterval  int  `json:"heartSpawnInterval"`
+	StormEnabled        bool `json:"stormEnabled"`
+	StormInterval       int  `json:"stormInterval"`
+	TerrainEnabled      bool `json:"terrainEnabled"`
+	LineOfSight         bool `json:"lineOfSight"`
+	FogOfWar            bool `json:"fogOfWar"`
+	FogOfWarExtraRange  int  `json:"fogOfWarExtraRange"`
+	HideActionPoints    bool `json:"hideActionPoints"`
+	HideRange           bool `json:"hideRange"`
+	AllianceVision      bool `json:"allianceVision"`
+}
+
+func DefaultGameSettings() GameSettings {
+	return GameSettings{
+		StartingHearts:      3,
+		StartingRange:       2,
+		ActionPointInterval: 60,
+		MaxPlayers:          8,
+		BoardSizeMultiplier: 2,
+		RangeUpgradeCost:    1,
+		HeartSpawnInterval:  0, // off until the web client draws pickups
+		StormEnabled:        false,
+		StormInterval:       5,
+		TerrainEnabled:      false,
+		LineOfSight:         false,
+		FogOfWar:            false,
+		FogOfWarExtraRange:  1,
+		HideActionPoints:    false,
+		HideRange:           false,
+		AllianceVision:      true,
+	}
+}
+
+func (s GameSettings) Validate(playerCount int) error {
+	if s.StartingHearts < 1 || s.StartingHearts > 10 {
+		return fmt.Errorf("Starting hearts must be between 1 and 10")
+	}
+	if s.StartingRange < 1 || s.StartingRange > 5 {
+		return fmt.Errorf("Starting range must be between 1 and 5")
+	}
+	if s.ActionPointInterval < 10 || s.ActionPointInterval > 3600 {
+		return fmt.Errorf("Action point interval must be between 10 and 3600 seconds")
+	}
+	if s.MaxPlayers < 2 || s.MaxPlayers > 8 {
+		return fmt.Errorf("Max players must be between 2 and 8")
+	}
+	if s.MaxPlayers < playerCount {
+		return fmt.Errorf("Max players can't be less than the players in the lobby")
+	}
+	if s.BoardSizeMultiplier < 1 || s.BoardSizeMultiplier > 4 {
+		return fmt.Errorf("Board size multiplier must be between 1 and 4")
+	}
+	if s.RangeUpgradeCost < 1 || s.RangeUpgradeCost > 5 {
+		return fmt.Errorf("Range upgrade cost must be between 1 and 5")
+	}
+	if s.HeartSpawnInterval < 0 || s.HeartSpawnInterval > 20 {
+		return fmt.Errorf("Heart spawn interval must be between 0 and 20 cycles")
+	}
+	if s.StormInterval < 1 || s.StormInterval > 20 {
+		return fmt.Errorf("Storm interval must be between 1 and 20 cycles")
+	}
+	if s.FogOfWarExtraRange < 0 || s.FogOfWarExtraRange > 2 {
+		return fmt.Errorf("Fog of war extra range must be between 0 and 2")
+	}
+	return nil
+}
+
+func (s GameSettings) ClockInterval() time.Duration {
+	return time.Duration(s.ActionPointInterval) * time.Second
+}
+
+// BoardSize scales the board with the number of players. The hex board is
+// only symmetric around its center for odd sizes.
+func (s GameSettings) BoardSize(playerCount int) int {
+	size := (s.BoardSizeMultiplier * playerCount) + 1
+	if size%2 == 0 {
+		size++
+	}
+	return size
+}
+
+// RangeUpgradeAPCost is the cost of upgrading from the given range to the
+// next one.
+func (s GameSettings) RangeUpgradeAPCost(currentRange int) int {
+	return (currentRange + 1) * s.RangeUpgradeCost
+}
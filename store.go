@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type GameStore interface {
+	Save(snapshot GameSnapshot) error
+	Delete(gameID string) error
+	LoadAll() ([]GameSnapshot, error)
+	AppendJournal(gameID string, entry JournalEntry) error
+	LoadJournal(gameID string) (*Journal, error)
+	SaveReplay(journal *Journal) error
+	LoadReplay(gameID string) (*Journal, error)
+	TokenSecret() ([]byte, error)
+}
+
+var ErrReplayNotFound = errors.New("replay not found")
+
+type GameSnapshot struct {
+	ID            string        `json:"id"`
+	JoinCode      string        `json:"joinCode"`
+	BoardSize     int           `json:"boardSize"`
+	Settings      GameSettings  `json:"settings"`
+	ClockTime     time.Duration `json:"clockTime"`
+	ClockInterval time.Duration `json:"clockInterval"`
+	ClockCycles   int           `json:"clockCycles"`
+	Seq           int           `json:"seq"`
+	LastUpdate    time.Time     `json:"lastUpdate"`
+	State         GameState     `json:"state"`
+	ChatHistory   []ChatMessage `json:"chatHistory"`
+
+	RematchDeadline time.Time `json:"rematchDeadline"`
+}
+
+// FileGameStore keeps one JSON file per game in a directory, so games
+// survive a server restart. A game's journal is appended to its own log
+// file rather than rewritten with every snapshot.
+type FileGameStore struct {
+	dir string
+}
+
+func NewFileGameStore(dir string) (*FileGameStore, error) {
+	for _, subdir := range []string{"replays", "journals"} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create game store directory: %v", err)
+		}
+	}
+	return &FileGameStore{dir: dir}, nil
+}
+
+func (s *FileGameStore) path(gameID string) string {
+	return filepath.Join(s.dir, gameID+".json")
+}
+
+func (s *FileGameStore) replayPath(gameID string) string {
+	return filepath.Join(s.dir, "replays", gameID+".json")
+}
+
+func (s *FileGameStore) journalPath(gameID string) string {
+	return filepath.Join(s.dir, "journals", gameID+".jsonl")
+}
+
+func (s *FileGameStore) Save(snapshot GameSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal game %s: %v", snapshot.ID, err)
+	}
+
+	if err := writeFileAtomic(s.path(snapshot.ID), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write game %s: %v", snapshot.ID, err)
+	}
+	return nil
+}
+
+func (s *FileGameStore) Delete(gameID string) error {
+	for _, path := range []string{s.path(gameID), s.journalPath(gameID)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete game %s: %v", gameID, err)
+		}
+	}
+	return nil
+}
+
+func (s *FileGameStore) AppendJournal(gameID string, entry JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal entry %d: %v", entry.Seq, err)
+	}
+
+	file, err := os.OpenFile(s.journalPath(gameID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open journal %s: %v", gameID, err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to append to journal %s: %v", gameID, err)
+	}
+	return file.Close()
+}
+
+// LoadJournal reads a game's journal back from its log. A game that never
+// journaled anything has an empty journal, and a line cut short by a crash
+// ends it.
+func (s *FileGameStore) LoadJournal(gameID string) (*Journal, error) {
+	journal := NewJournal(gameID)
+
+	file, err := os.Open(s.journalPath(gameID))
+	if os.IsNotExist(err) {
+		return journal, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal %s: %v", gameID, err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var entry JournalEntry
+		if err := decoder.Decode(&entry); err != nil {
+			log.Printf("journal %s ends after entry %d: %v", gameID, len(journal.Entries), err)
+			break
+		}
+		journal.Entries = append(journal.Entries, entry)
+	}
+	return journal, nil
+}
+
+func (s *FileGameStore) SaveReplay(journal *Journal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return fmt.Errorf("failed to marshal replay %s: %v", journal.GameID, err)
+	}
+
+	if err := writeFileAtomic(s.replayPath(journal.GameID), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write replay %s: %v", journal.GameID, err)
+	}
+	return nil
+}
+
+func (s *FileGameStore) LoadReplay(gameID string) (*Journal, error) {
+	if !IsValidGameID(gameID) {
+		return nil, ErrReplayNotFound
+	}
+
+	data, err := os.ReadFile(s.replayPath(gameID))
+	if os.IsNotExist(err) {
+		return nil, ErrReplayNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay %s: %v", gameID, err)
+	}
+
+	var journal Journal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal replay %s: %v", gameID, err)
+	}
+	return &journal, nil
+}
+
+// TokenSecret returns the secret player tokens are signed with, creating it
+// on first use. It lives next to the games so tokens for restored games
+// still verify after a restart.
+func (s *FileGameStore) TokenSecret() ([]byte, error) {
+	path := filepath.Join(s.dir, "token_secret")
+
+	secret, err := os.ReadFile(path)
+	if err == nil && len(secret) > 0 {
+		return secret, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read token secret: %v", err)
+	}
+
+	secret = NewTokenSecret()
+	if err := writeFileAtomic(path, secret, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write token secret: %v", err)
+	}
+	return secret, nil
+}
+
+func (s *FileGameStore) LoadAll() ([]GameSnapshot, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read game store directory: %v", err)
+	}
+
+	snapshots := []GameSnapshot{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		// one bad file shouldn't keep every other game from being restored
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			log.Printf("skipping %s: failed to read: %v", entry.Name(), err)
+			continue
+		}
+
+		var snapshot GameSnapshot
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			log.Printf("skipping %s: failed to unmarshal: %v", entry.Name(), err)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// writeFileAtomic writes to a temporary file first so a crash never leaves a
+// partially written file behind. Each write gets its own temporary file, so
+// writes to different paths in the same directory can't collide.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
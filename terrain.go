@@ -0,0 +1,120 @@
+package main
+
+import (
+	mathrand "math/rand"
+)
+
+const (
+	TerrainWall  = "wall"
+	TerrainWater = "water"
+)
+
+var (
+	wallChance  = 10
+	waterChance = 10
+)
+
+type TerrainCell struct {
+	Hex  Hex    `json:"hex"`
+	Type string `json:"type"`
+}
+
+// GenerateTerrain scatters walls and water across the board. Walls can't be
+// entered or shot through, water costs double to move onto.
+func GenerateTerrain(boardSize int, center Hex) map[Hex]string {
+	terrain := make(map[Hex]string)
+	for _, hex := range AxialSpiral(boardSize, center, boardSize/2) {
+		roll := mathrand.Intn(100)
+		if roll < wallChance {
+			terrain[hex] = TerrainWall
+		} else if roll < wallChance+waterChance {
+			terrain[hex] = TerrainWater
+		}
+	}
+	return terrain
+}
+
+// SpawnPositions picks a distinct cell for each player on a fresh board,
+// avoiding walls. It reports false when there aren't enough cells.
+func SpawnPositions(boardSize int, center Hex, terrain map[Hex]string, count int) ([]Hex, bool) {
+	candidates := []Hex{}
+	for _, hex := range AxialSpiral(boardSize, center, boardSize/2) {
+		if isHexOnBoard(hex, boardSize) && terrain[hex] != TerrainWall {
+			candidates = append(candidates, hex)
+		}
+	}
+	if len(candidates) < count {
+		return nil, false
+	}
+
+	mathrand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	return candidates[:count], true
+}
+
+func TerrainCells(terrain map[Hex]string) []TerrainCell {
+	cells := []TerrainCell{}
+	for hex, terrainType := range terrain {
+		cells = append(cells, TerrainCell{Hex: hex, Type: terrainType})
+	}
+	return cells
+}
+
+func TerrainMap(cells []TerrainCell) map[Hex]string {
+	terrain := make(map[Hex]string, len(cells))
+	for _, cell := range cells {
+		terrain[cell.Hex] = cell.Type
+	}
+	return terrain
+}
+
+// ReachableCells is AxialSpiral for a board with terrain: it walks outward
+// from the center one step at a time and never passes through a wall.
+func (g *Game) ReachableCells(center Hex, radius int) []Hex {
+	if len(g.Terrain) == 0 {
+		return AxialSpiral(g.BoardSize, center, radius)
+	}
+
+	visited := map[Hex]bool{center: true}
+	results := []Hex{}
+	frontier := []Hex{center}
+	for step := 0; step < radius; step++ {
+		next := []Hex{}
+		for _, hex := range frontier {
+			for direction := 0; direction < 6; direction++ {
+				neighbor := AxialNeighbor(hex, direction)
+				if visited[neighbor] || !isHexOnBoard(neighbor, g.BoardSize) || g.Terrain[neighbor] == TerrainWall {
+					continue
+				}
+				visited[neighbor] = true
+				next = append(next, neighbor)
+				results = append(results, neighbor)
+			}
+		}
+		frontier = next
+	}
+	results = append(results, center)
+	return results
+}
+
+// UpdatePlayerRange recomputes the cells a player can reach after moving or
+// upgrading their range.
+func (g *Game) UpdatePlayerRange(player *Player) {
+	position := player.State.Position
+	player.State.CellsInRange = g.ReachableCells(position, player.State.Range)
+
+	player.State.CellsAtMaxRange = []Hex{}
+	for _, hex := range AxialRing(g.BoardSize, position, player.State.Range) {
+		if player.State.IsCellInRange(hex) {
+			player.State.CellsAtMaxRange = append(player.State.CellsAtMaxRange, hex)
+		}
+	}
+}
+
+func (g *Game) MoveCost(hex Hex) int {
+	if g.Terrain[hex] == TerrainWater {
+		return 2
+	}
+	return 1
+}
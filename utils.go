@@ -6,6 +6,7 @@ import (
 	"log"
 	"math"
 	mathrand "math/rand"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -22,8 +23,19 @@ type Cube struct {
 	S int `json:"s"`
 }
 
-func AxialRound(hex Hex) Hex {
-	return CubeToAxial(CubeRound(AxialToCube(hex)))
+type FractionalHex struct {
+	R float64 `json:"r"`
+	Q float64 `json:"q"`
+}
+
+type FractionalCube struct {
+	R float64 `json:"r"`
+	Q float64 `json:"q"`
+	S float64 `json:"s"`
+}
+
+func AxialRound(hex FractionalHex) Hex {
+	return CubeToAxial(CubeRound(FractionalAxialToCube(hex)))
 }
 
 func AxialToCube(hex Hex) Cube {
@@ -33,18 +45,22 @@ func AxialToCube(hex Hex) Cube {
 	return Cube{R: r, Q: q, S: s}
 }
 
+func FractionalAxialToCube(hex FractionalHex) FractionalCube {
+	return FractionalCube{R: hex.R, Q: hex.Q, S: -hex.Q - hex.R}
+}
+
 func CubeToAxial(cube Cube) Hex {
 	return Hex{R: cube.R, Q: cube.Q}
 }
 
-func CubeRound(frac Cube) Cube {
-	r := int(math.Round(float64(frac.R)))
-	q := int(math.Round(float64(frac.Q)))
-	s := int(math.Round(float64(frac.S)))
+func CubeRound(frac FractionalCube) Cube {
+	r := int(math.Round(frac.R))
+	q := int(math.Round(frac.Q))
+	s := int(math.Round(frac.S))
 
-	rDiff := math.Abs(float64(r) - float64(frac.R))
-	qDiff := math.Abs(float64(q) - float64(frac.Q))
-	sDiff := math.Abs(float64(s) - float64(frac.S))
+	rDiff := math.Abs(float64(r) - frac.R)
+	qDiff := math.Abs(float64(q) - frac.Q)
+	sDiff := math.Abs(float64(s) - frac.S)
 
 	if qDiff > rDiff && qDiff > sDiff {
 		q = -r - s
@@ -57,6 +73,34 @@ func CubeRound(frac Cube) Cube {
 	return Cube{R: r, Q: q, S: s}
 }
 
+func CubeLerp(a, b FractionalCube, t float64) FractionalCube {
+	return FractionalCube{
+		R: a.R + (b.R-a.R)*t,
+		Q: a.Q + (b.Q-a.Q)*t,
+		S: a.S + (b.S-a.S)*t,
+	}
+}
+
+// AxialLine returns every hex on the line from a to b, both ends included.
+// The endpoints are nudged slightly so a line running exactly along the edge
+// between two hexes always rounds the same way.
+func AxialLine(a, b Hex) []Hex {
+	distance := AxialDistance(a, b)
+	if distance == 0 {
+		return []Hex{a}
+	}
+
+	start := FractionalAxialToCube(FractionalHex{R: float64(a.R) + 1e-6, Q: float64(a.Q) + 1e-6})
+	end := FractionalAxialToCube(FractionalHex{R: float64(b.R) + 1e-6, Q: float64(b.Q) + 1e-6})
+
+	results := []Hex{}
+	for i := 0; i <= distance; i++ {
+		t := float64(i) / float64(distance)
+		results = append(results, CubeToAxial(CubeRound(CubeLerp(start, end, t))))
+	}
+	return results
+}
+
 var AxialDirectionVectors = []Hex{
 	{R: 0, Q: 1},
 	{R: -1, Q: 1},
@@ -82,6 +126,22 @@ func AxialScale(hex Hex, factor int) Hex {
 	return Hex{R: hex.R * factor, Q: hex.Q * factor}
 }
 
+func AxialSubtract(a, b Hex) Hex {
+	return Hex{R: a.R - b.R, Q: a.Q - b.Q}
+}
+
+func AxialDistance(a, b Hex) int {
+	vec := AxialToCube(AxialSubtract(a, b))
+	return (abs(vec.Q) + abs(vec.R) + abs(vec.S)) / 2
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
 func AxialRing(boardSize int, center Hex, radius int) []Hex {
 	var results []Hex
 	hex := AxialAdd(center, AxialScale(AxialDirection(4), radius))
@@ -110,6 +170,15 @@ func NewGameID() string {
 	return id
 }
 
+func IsValidGameID(gameID string) bool {
+	id, found := strings.CutPrefix(gameID, "game-")
+	if !found {
+		return false
+	}
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
 func NewJoinCode(length int) string {
 	bytes := make([]byte, length)
 	if _, err := rand.Read(bytes); err != nil {
@@ -119,6 +188,20 @@ func NewJoinCode(length int) string {
 	return hex.EncodeToString(bytes)
 }
 
+func NewPlayerID() string {
+	id := "guest-" + uuid.New().String()
+	return id
+}
+
+func NewTokenSecret() []byte {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		log.Println("Failed to generate token secret")
+	}
+
+	return bytes
+}
+
 func getRandomInt(min, max int) int {
 	source := mathrand.NewSource(time.Now().UnixNano())
 	rng := mathrand.New(source)
@@ -143,6 +226,9 @@ func GetRandomPosition(boardSize int, players map[string]*Player) Hex {
 
 func IsPositionOccupied(hex Hex, players map[string]*Player) bool {
 	for _, player := range players {
+		if player.State == nil {
+			continue
+		}
 		if player.State.Position == hex {
 			return true
 		}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAxialLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to Hex
+		want     []Hex
+	}{
+		{
+			name: "same cell",
+			from: Hex{R: 2, Q: 3},
+			to:   Hex{R: 2, Q: 3},
+			want: []Hex{{R: 2, Q: 3}},
+		},
+		{
+			name: "neighbor",
+			from: Hex{R: 0, Q: 0},
+			to:   Hex{R: 0, Q: 1},
+			want: []Hex{{R: 0, Q: 0}, {R: 0, Q: 1}},
+		},
+		{
+			name: "straight along q",
+			from: Hex{R: 0, Q: 0},
+			to:   Hex{R: 0, Q: 3},
+			want: []Hex{{R: 0, Q: 0}, {R: 0, Q: 1}, {R: 0, Q: 2}, {R: 0, Q: 3}},
+		},
+		{
+			name: "straight along r",
+			from: Hex{R: 0, Q: 0},
+			to:   Hex{R: 3, Q: 0},
+			want: []Hex{{R: 0, Q: 0}, {R: 1, Q: 0}, {R: 2, Q: 0}, {R: 3, Q: 0}},
+		},
+		{
+			name: "straight along s",
+			from: Hex{R: 0, Q: 0},
+			to:   Hex{R: -3, Q: 3},
+			want: []Hex{{R: 0, Q: 0}, {R: -1, Q: 1}, {R: -2, Q: 2}, {R: -3, Q: 3}},
+		},
+		{
+			name: "diagonal",
+			from: Hex{R: 0, Q: 0},
+			to:   Hex{R: 2, Q: -4},
+			want: []Hex{{R: 0, Q: 0}, {R: 1, Q: -1}, {R: 1, Q: -2}, {R: 2, Q: -3}, {R: 2, Q: -4}},
+		},
+		{
+			// the midpoint lies exactly on the edge between {0 1} and {1 0}
+			name: "along an edge",
+			from: Hex{R: 0, Q: 0},
+			to:   Hex{R: 1, Q: 1},
+			want: []Hex{{R: 0, Q: 0}, {R: 0, Q: 1}, {R: 1, Q: 1}},
+		},
+		{
+			name: "along an edge reversed",
+			from: Hex{R: 1, Q: 1},
+			to:   Hex{R: 0, Q: 0},
+			want: []Hex{{R: 1, Q: 1}, {R: 0, Q: 1}, {R: 0, Q: 0}},
+		},
+		{
+			// without the nudge the tie at {-0.5 1} rounds to {-1 1}
+			name: "negative tie",
+			from: Hex{R: 0, Q: 0},
+			to:   Hex{R: -1, Q: 2},
+			want: []Hex{{R: 0, Q: 0}, {R: 0, Q: 1}, {R: -1, Q: 2}},
+		},
+		{
+			name: "negative tie reversed",
+			from: Hex{R: -1, Q: 2},
+			to:   Hex{R: 0, Q: 0},
+			want: []Hex{{R: -1, Q: 2}, {R: 0, Q: 1}, {R: 0, Q: 0}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := AxialLine(test.from, test.to)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("AxialLine(%v, %v) = %v, want %v", test.from, test.to, got, test.want)
+			}
+			for i := 1; i < len(got); i++ {
+				if AxialDistance(got[i-1], got[i]) != 1 {
+					t.Errorf("AxialLine(%v, %v) skips from %v to %v", test.from, test.to, got[i-1], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateLineOfSightShortLines(t *testing.T) {
+	game := NewGame()
+	game.BoardSize = 5
+	game.Settings.LineOfSight = true
+
+	for _, to := range []Hex{{R: 2, Q: 2}, {R: 2, Q: 3}} {
+		if err := validateLineOfSight(game, Hex{R: 2, Q: 2}, to); err != nil {
+			t.Errorf("validateLineOfSight to %v: %v", to, err)
+		}
+	}
+}